@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"aws-photos-backup/internal/photosbackup"
+)
+
+func runBackup(ctx context.Context, g *globalFlags, args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	format := fs.String("format", "table", "how --dry-run prints the plan: table or json")
+	seed := fs.Bool("seed-last-upload", false, "on the first run with a catalog, record the files of photos_library_path backed up before last_upload_file as backed up, unconfirmed, instead of uploading them")
+	parseFlags(fs, g, args)
+	if *format != "table" && *format != "json" {
+		return fmt.Errorf("unknown -format %q, want table or json", *format)
+	}
+	if *format == "json" && !g.dryRun {
+		return errors.New("-format json requires --dry-run")
+	}
+	// Keep stdout for the JSON plan alone
+	out := io.Writer(os.Stdout)
+	if *format == "json" {
+		out = os.Stderr
+	}
+	r, err := newRunner(ctx, g, out)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if *seed {
+		if _, err := r.Seed(ctx); err != nil {
+			return fmt.Errorf("seed catalog: %w", err)
+		}
+	}
+	res, err := r.Backup(ctx)
+	if err != nil {
+		return err
+	}
+	if g.dryRun {
+		plan := r.Plan(res)
+		if *format == "json" {
+			return plan.WriteJSON(os.Stdout)
+		}
+		fmt.Println()
+		return plan.WriteTable(os.Stdout)
+	}
+	if res.Failed > 0 {
+		return fmt.Errorf("%d archives failed to upload", res.Failed)
+	}
+	return nil
+}
+
+func runRestore(ctx context.Context, g *globalFlags, args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	var opts photosbackup.RestoreOptions
+	fs.StringVar(&opts.From, "from", "", "first year-month to restore (YYYY-MM), inclusive")
+	fs.StringVar(&opts.To, "to", "", "last year-month to restore (YYYY-MM), inclusive")
+	fs.StringVar(&opts.StateFile, "state", "", "restore the archives recorded in this upload state file instead of listing the backend")
+	fs.StringVar(&opts.Dest, "dest", "", "directory to extract the archives into (required)")
+	fs.StringVar(&opts.Source, "source", "", "restore only this source (default: all; with several sources, each goes into a subdirectory of -dest)")
+	parseFlags(fs, g, args)
+	if opts.Dest == "" {
+		fmt.Fprintln(os.Stderr, "restore: -dest is required")
+		fs.Usage()
+		os.Exit(2)
+	}
+	r, err := newRunner(ctx, g, os.Stdout)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	stats, failed, err := r.Restore(ctx, opts)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Restore complete. Archives: %d, files restored: %d, unchanged files skipped: %d, failed archives: %d\n",
+		stats.Archives, stats.Restored, stats.Skipped, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d archives failed to restore", failed)
+	}
+	return nil
+}
+
+func runVerify(ctx context.Context, g *globalFlags, args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	from := fs.String("from", "", "first year-month to verify (YYYY-MM), inclusive")
+	to := fs.String("to", "", "last year-month to verify (YYYY-MM), inclusive")
+	source := fs.String("source", "", "verify only this source")
+	download := fs.Bool("download", false, "download every archive and check its checksum, CRCs and manifest (archives in GLACIER must be restored first)")
+	parseFlags(fs, g, args)
+	r, err := newRunner(ctx, g, os.Stdout)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	res, err := r.Verify(ctx, *source, *from, *to, *download)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Verified %d archives", res.Archives)
+	if *download {
+		fmt.Printf(" holding %d files", res.Files)
+	}
+	fmt.Printf(". Problems: %d", res.Failed)
+	if res.Unconfirmed > 0 {
+		fmt.Printf(". Seeded files not confirmed in any archive: %d", res.Unconfirmed)
+	}
+	fmt.Println()
+	if res.Failed > 0 {
+		return fmt.Errorf("%d problems found", res.Failed)
+	}
+	return nil
+}
+
+func runList(ctx context.Context, g *globalFlags, args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	from := fs.String("from", "", "first year-month to list (YYYY-MM), inclusive")
+	to := fs.String("to", "", "last year-month to list (YYYY-MM), inclusive")
+	source := fs.String("source", "", "list only this source")
+	parseFlags(fs, g, args)
+	r, err := newRunner(ctx, g, os.Stdout)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	lists, err := r.ListArchives(ctx, *source, *from, *to)
+	if err != nil {
+		return err
+	}
+	for _, l := range lists {
+		if len(lists) > 1 {
+			fmt.Printf("%s:\n", l.Source.Label())
+		}
+		var total int64
+		for _, a := range l.Archives {
+			total += a.Size
+			fmt.Printf("  %s  %10.1f MiB  %-12s %s\n", a.LastModified.Format("2006-01-02 15:04"), float64(a.Size)/(1<<20), a.StorageClass, a.Key)
+		}
+		fmt.Printf("  %d archives, %.1f GiB\n", len(l.Archives), float64(total)/(1<<30))
+	}
+	return nil
+}
+
+func runStatus(ctx context.Context, g *globalFlags, args []string) error {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	parseFlags(fs, g, args)
+	r, err := newRunner(ctx, g, os.Stdout)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	r.Status()
+	return nil
+}
+
+func runPrune(ctx context.Context, g *globalFlags, args []string) error {
+	fs := flag.NewFlagSet("prune", flag.ExitOnError)
+	source := fs.String("source", "", "prune only this source")
+	yes := fs.Bool("yes", false, "delete the archives; without it they are only listed")
+	parseFlags(fs, g, args)
+	r, err := newRunner(ctx, g, os.Stdout)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	res, err := r.Prune(ctx, *source, *yes)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d unreferenced archives (%.1f MiB), %d deleted, %d kept as they predate the catalog\n", res.Archives, float64(res.Bytes)/(1<<20), res.Deleted, res.Kept)
+	if res.Unconfirmed > 0 {
+		fmt.Printf("%d seeded files are not confirmed to be in any archive\n", res.Unconfirmed)
+	}
+	if res.Archives > res.Deleted+res.Kept && !*yes {
+		fmt.Println("Run prune -yes to delete them.")
+	}
+	return nil
+}
+
+func runCache(ctx context.Context, g *globalFlags, args []string) error {
+	fs := flag.NewFlagSet("cache", flag.ExitOnError)
+	all := fs.Bool("all", false, "remove every entry, so the next run rereads all metadata")
+	stale := fs.Bool("stale", false, "remove entries for files that were deleted or changed")
+	exts := fs.String("ext", "", "remove entries for these extensions, comma separated (e.g. .heic,.mov)")
+	dir := fs.String("path", "", "remove entries for files below this directory")
+	parseFlags(fs, g, args)
+
+	cfg, _, err := loadConfig(g)
+	if err != nil {
+		return err
+	}
+	cachePath := cfg.ScanCacheFile
+	cache, err := photosbackup.LoadScanCache(cachePath)
+	if err != nil {
+		return fmt.Errorf("load scan cache: %w", err)
+	}
+
+	if !*all && !*stale && *exts == "" && *dir == "" {
+		fmt.Printf("%s holds metadata for %d files. Use -all, -stale, -ext or -path to invalidate entries.\n", cachePath, len(cache.Entries))
+		return nil
+	}
+
+	// Remove the matching entries; the next run rereads those files
+	removed := 0
+	if *all {
+		removed += cache.Invalidate(photosbackup.InvalidateAll)
+	}
+	if *stale {
+		removed += cache.Invalidate(photosbackup.InvalidateStale)
+	}
+	if *exts != "" {
+		removed += cache.Invalidate(photosbackup.InvalidateExtensions(strings.Split(*exts, ",")))
+	}
+	if *dir != "" {
+		removed += cache.Invalidate(photosbackup.InvalidatePrefix(*dir))
+	}
+	if g.dryRun {
+		fmt.Printf("[DRY RUN] Would remove %d entries from %s\n", removed, cachePath)
+		return nil
+	}
+	if err := photosbackup.SaveScanCache(cachePath, cache); err != nil {
+		return fmt.Errorf("save scan cache: %w", err)
+	}
+	fmt.Printf("Removed %d entries from %s, %d left\n", removed, cachePath, len(cache.Entries))
+	return nil
+}
+
+func runConfig(ctx context.Context, g *globalFlags, args []string) error {
+	if len(args) == 0 || (args[0] != "validate" && args[0] != "show") {
+		return errors.New("usage: photos-backup config validate|show [flags]")
+	}
+	fs := flag.NewFlagSet("config "+args[0], flag.ExitOnError)
+	parseFlags(fs, g, args[1:])
+	cfg, origins, err := loadConfig(g)
+	if err != nil {
+		return err
+	}
+	if args[0] == "show" {
+		return showConfig(g, cfg, origins)
+	}
+	// Validate reports one problem per line
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("the config is invalid:\n  %s", strings.ReplaceAll(err.Error(), "\n", "\n  "))
+	}
+	sources, _ := cfg.BackupSources()
+	fmt.Println("The config is valid. Sources:")
+	for _, src := range sources {
+		fmt.Printf("  %s: %s\n", src.Label(), src.Path)
+	}
+	return nil
+}
+
+// showConfig prints every setting with its value and the layer it was taken from.
+func showConfig(g *globalFlags, cfg *photosbackup.Config, origins photosbackup.Origins) error {
+	path, required := g.layers().ConfigFile()
+	if _, err := os.Stat(path); err != nil && !required {
+		path += " (not found, skipped)"
+	}
+	fmt.Printf("Config file: %s\n\n", path)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SETTING\tVALUE\tFROM")
+	for _, s := range photosbackup.Settings() {
+		value, from := s.Format(cfg), origins[s.Key]
+		if from == "" {
+			value, from = "-", "unset"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", s.Key, value, from)
+	}
+	return tw.Flush()
+}
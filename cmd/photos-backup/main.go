@@ -0,0 +1,177 @@
+// Command photos-backup backs up photo libraries to S3 or a local directory as monthly
+// zip archives, and restores, lists, verifies and prunes those archives.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+
+	"aws-photos-backup/internal/photosbackup"
+)
+
+// globalFlags are accepted before the command and by every command.
+type globalFlags struct {
+	config   string
+	dryRun   bool
+	limit    int
+	prefix   string
+	settings map[string]string // Config settings given as flags, by key
+}
+
+// register adds the global flags to fs, and a flag for every config setting. Their
+// current values are the defaults, so flags given before the command are kept when the
+// command's flags are parsed.
+func (g *globalFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&g.config, "config", g.config, "path to the config file (default $"+photosbackup.ConfigEnv+", or "+photosbackup.DefaultConfigFile+" if it exists)")
+	fs.BoolVar(&g.dryRun, "dry-run", g.dryRun, "report what would be done without uploading, restoring or deleting anything")
+	fs.IntVar(&g.limit, "limit", g.limit, "upload at most this many new files per source (0: no limit, or test_mode_limit with -prefix)")
+	fs.StringVar(&g.prefix, "prefix", g.prefix, "prepend this to every key, e.g. test/; such runs keep their own catalog and upload state")
+	for _, s := range photosbackup.Settings() {
+		set := func(v string) error {
+			g.settings[s.Key] = v
+			return nil
+		}
+		usage := "set " + s.Key + ", overriding the config file and $" + s.Env
+		if s.Bool {
+			fs.BoolFunc(s.Flag, usage, set)
+		} else {
+			fs.Func(s.Flag, usage, set)
+		}
+	}
+}
+
+// printDefaults prints the flags of fs like fs.PrintDefaults, but lists the flags of
+// config settings by name only.
+func printDefaults(fs *flag.FlagSet) {
+	settings := make(map[string]bool)
+	var names []string
+	for _, s := range photosbackup.Settings() {
+		settings[s.Flag] = true
+		names = append(names, "--"+s.Flag)
+	}
+	own := flag.NewFlagSet(fs.Name(), flag.ContinueOnError)
+	own.SetOutput(fs.Output())
+	fs.VisitAll(func(f *flag.Flag) {
+		if !settings[f.Name] {
+			own.Var(f.Value, f.Name, f.Usage)
+		}
+	})
+	own.PrintDefaults()
+	fmt.Fprintf(fs.Output(), "\nConfig settings, which override the config file and the %s* environment variables\n(run config show for their values):\n", photosbackup.EnvPrefix)
+	line := " "
+	for _, name := range names {
+		if len(line)+len(name) > 88 {
+			fmt.Fprintln(fs.Output(), line)
+			line = " "
+		}
+		line += " " + name
+	}
+	fmt.Fprintln(fs.Output(), line)
+}
+
+// command is a subcommand. run receives the arguments after the command name.
+type command struct {
+	name    string
+	summary string
+	run     func(ctx context.Context, g *globalFlags, args []string) error
+}
+
+var commands = []command{
+	{"backup", "scan the sources and upload new files as monthly archives", runBackup},
+	{"restore", "download archives and extract them into a directory", runRestore},
+	{"verify", "check that the catalog's archives exist and are intact", runVerify},
+	{"list", "list the archives of each source", runList},
+	{"status", "show the sources, recorded months, catalog and scan cache", runStatus},
+	{"prune", "delete archives that the catalog and upload state no longer refer to", runPrune},
+	{"cache", "show or invalidate entries of the scan cache", runCache},
+	{"config", "check the config (config validate) or show it with where each value comes from (config show)", runConfig},
+}
+
+func usage(fs *flag.FlagSet) {
+	out := fs.Output()
+	fmt.Fprintf(out, "Usage: photos-backup [global flags] <command> [flags]\n\nCommands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(out, "  %-8s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintf(out, "\nGlobal flags:\n")
+	printDefaults(fs)
+}
+
+func main() {
+	g := globalFlags{settings: make(map[string]string)}
+	fs := flag.NewFlagSet("photos-backup", flag.ExitOnError)
+	g.register(fs)
+	fs.Usage = func() { usage(fs) }
+	fs.Parse(os.Args[1:])
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	// Ctrl-C cancels scans and in-flight transfers
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	name := fs.Arg(0)
+	for _, c := range commands {
+		if c.name == name {
+			if err := c.run(ctx, &g, fs.Args()[1:]); err != nil {
+				log.Fatalf("%s: %v", name, err)
+			}
+			return
+		}
+	}
+	fmt.Fprintf(os.Stderr, "photos-backup: unknown command %q\n\n", name)
+	fs.Usage()
+	os.Exit(2)
+}
+
+// parseFlags parses the flags of a command, which also accepts the global flags.
+func parseFlags(fs *flag.FlagSet, g *globalFlags, args []string) {
+	g.register(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage of %s:\n", fs.Name())
+		printDefaults(fs)
+	}
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "%s: unexpected arguments %s\n", fs.Name(), strings.Join(fs.Args(), " "))
+		fs.Usage()
+		os.Exit(2)
+	}
+}
+
+// layers returns where the config is read from.
+func (g *globalFlags) layers() photosbackup.ConfigLayers {
+	return photosbackup.ConfigLayers{File: g.config, Env: os.Environ(), Flags: g.settings}
+}
+
+// loadConfig reads the config from the file, the environment and the flags.
+func loadConfig(g *globalFlags) (*photosbackup.Config, photosbackup.Origins, error) {
+	cfg, origins, err := photosbackup.ResolveConfig(g.layers())
+	if err != nil {
+		return nil, nil, fmt.Errorf("load config: %w", err)
+	}
+	return cfg, origins, nil
+}
+
+// newRunner loads the config and sets up a Runner with the global flags. The Runner
+// prints its progress to out; the caller closes it.
+func newRunner(ctx context.Context, g *globalFlags, out io.Writer) (*photosbackup.Runner, error) {
+	cfg, _, err := loadConfig(g)
+	if err != nil {
+		return nil, err
+	}
+	return photosbackup.NewRunner(ctx, cfg, photosbackup.RunOptions{
+		DryRun: g.dryRun,
+		Limit:  g.limit,
+		Prefix: g.prefix,
+		Out:    out,
+	})
+}
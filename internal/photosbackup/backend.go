@@ -0,0 +1,87 @@
+package photosbackup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// BackendConfig selects where archives are stored.
+type BackendConfig struct {
+	Type string `yaml:"type"` // "s3" (default) or "local"
+	Path string `yaml:"path"` // Root directory for the local backend
+}
+
+// ObjectInfo describes a stored object.
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+	StorageClass string
+	// ChecksumSHA256 is the base64 SHA256 checksum recorded by the backend;
+	// multipart S3 objects carry a composite checksum ending in "-<parts>".
+	ChecksumSHA256 string
+}
+
+// PutOptions holds per-object settings for Put.
+type PutOptions struct {
+	StorageClass string
+	// PartSize raises the part size of multipart uploads for this object, so that large
+	// bodies of unknown length fit in maxUploadParts parts. See ArchivePartSize.
+	PartSize int64
+}
+
+// maxUploadParts is the most parts S3 accepts in a multipart upload.
+const maxUploadParts = 10000
+
+// ArchivePartSize returns the part size for an archive of files totalling bytes:
+// minSize, or more if the archive would not fit in maxUploadParts parts of minSize.
+// Streamed archives have no known length, so the uploader cannot raise it itself.
+// It leaves room for zip headers and the manifest, and is a whole number of MiB.
+func ArchivePartSize(bytes, minSize int64) int64 {
+	// Photos and videos barely compress; deflate may even add a little
+	size := bytes + bytes/100 + 64<<20
+	part := (size + maxUploadParts - 1) / maxUploadParts
+	part = (part + 1<<20 - 1) &^ (1<<20 - 1)
+	return max(part, minSize)
+}
+
+// Backend is a storage target for archives. Missing objects are reported
+// with errors that match os.ErrNotExist.
+type Backend interface {
+	Put(ctx context.Context, key string, body io.Reader, opts PutOptions) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Head(ctx context.Context, key string) (ObjectInfo, error)
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// NewBackend returns the backend selected by cfg.Backend.
+func NewBackend(ctx context.Context, cfg *Config) (Backend, error) {
+	switch strings.ToLower(cfg.Backend.Type) {
+	case "", "s3":
+		b, err := NewS3Backend(ctx, cfg.S3Bucket, cfg.Region)
+		if err != nil {
+			return nil, err
+		}
+		b.PartSize = int64(cfg.UploadPartSizeMB) * 1024 * 1024
+		return b, nil
+	case "local":
+		return NewLocalBackend(cfg.Backend.Path)
+	default:
+		return nil, fmt.Errorf("unknown backend type %q", cfg.Backend.Type)
+	}
+}
+
+// UploadFile stores the local file at path under key.
+func UploadFile(ctx context.Context, b Backend, key, path string, storageClass string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return b.Put(ctx, key, file, PutOptions{StorageClass: storageClass})
+}
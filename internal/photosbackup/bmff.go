@@ -0,0 +1,89 @@
+package photosbackup
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// ISO base media file format (ISO/IEC 14496-12) helpers shared by the QuickTime/MP4
+// and HEIF parsers. A file is a sequence of boxes ("atoms" in QuickTime), each with a
+// 32-bit size, a four-character type and a payload that may itself hold boxes.
+
+// maxBoxRead bounds how much of a box is read into memory. Metadata boxes are small;
+// media data boxes are skipped, never read.
+const maxBoxRead = 64 << 20
+
+// readTopLevelBox returns the payload of the first top-level box of type typ in r,
+// which is size bytes long, or nil if there is none.
+func readTopLevelBox(r io.ReaderAt, size int64, typ string) ([]byte, error) {
+	var hdr [16]byte
+	for off := int64(0); off+8 <= size; {
+		n, err := r.ReadAt(hdr[:], off)
+		if n < 8 {
+			return nil, err
+		}
+		boxSize, hdrLen := int64(binary.BigEndian.Uint32(hdr[0:4])), int64(8)
+		switch boxSize {
+		case 0: // box extends to the end of the file
+			boxSize = size - off
+		case 1: // 64-bit size follows the type
+			if n < 16 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			boxSize, hdrLen = int64(binary.BigEndian.Uint64(hdr[8:16])), 16
+		}
+		if boxSize < hdrLen || off+boxSize > size {
+			return nil, fmt.Errorf("malformed %q box at offset %d", hdr[4:8], off)
+		}
+		if string(hdr[4:8]) == typ {
+			if boxSize-hdrLen > maxBoxRead {
+				return nil, fmt.Errorf("%q box too large (%d bytes)", typ, boxSize)
+			}
+			payload := make([]byte, boxSize-hdrLen)
+			if _, err := r.ReadAt(payload, off+hdrLen); err != nil && err != io.EOF {
+				return nil, err
+			}
+			return payload, nil
+		}
+		off += boxSize
+	}
+	return nil, nil
+}
+
+// walkBoxes calls fn for each box in data with its type and payload, stopping at the
+// first malformed box or when fn returns false.
+func walkBoxes(data []byte, fn func(typ string, payload []byte) bool) {
+	for len(data) >= 8 {
+		size, hdrLen := uint64(binary.BigEndian.Uint32(data[0:4])), uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return
+			}
+			size, hdrLen = binary.BigEndian.Uint64(data[8:16]), 16
+		}
+		if size < hdrLen || size > uint64(len(data)) {
+			return
+		}
+		if !fn(string(data[4:8]), data[hdrLen:size]) {
+			return
+		}
+		data = data[size:]
+	}
+}
+
+// findBox returns the payload of the first box of type typ in data, or nil.
+func findBox(data []byte, typ string) []byte {
+	var found []byte
+	walkBoxes(data, func(t string, payload []byte) bool {
+		if t == typ {
+			found = payload
+			return false
+		}
+		return true
+	})
+	return found
+}
@@ -0,0 +1,565 @@
+package photosbackup
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// CatalogEntry records one backed-up file and where its content is stored.
+type CatalogEntry struct {
+	SHA256       string    `json:"sha256"`
+	SourcePath   string    `json:"source_path"`
+	Size         int64     `json:"size"`
+	ModTime      time.Time `json:"mtime"`
+	Inode        uint64    `json:"inode,omitempty"`
+	Meta         PhotoMeta `json:"meta"`
+	Archive      string    `json:"archive"`
+	Member       string    `json:"member"`
+	Key          string    `json:"key"`
+	StorageClass string    `json:"storage_class,omitempty"`
+	Uploaded     time.Time `json:"uploaded"`
+	// Aliases are other source paths with identical content. They are not uploaded
+	// again; restores recreate them from the archive location above (see ArchiveAliases).
+	Aliases []CatalogAlias `json:"aliases,omitempty"`
+}
+
+// CatalogAlias is another source path of a catalogued file.
+type CatalogAlias struct {
+	Path    string    `json:"path"`
+	ModTime time.Time `json:"mtime"`
+	Inode   uint64    `json:"inode,omitempty"`
+}
+
+// The catalog is a bbolt database with two buckets, both holding JSON values. Entries
+// are written as files are recorded, so a run never holds the whole catalog in memory
+// or rewrites it.
+var (
+	entriesBucket = []byte("entries") // SHA256 → CatalogEntry
+	pathsBucket   = []byte("paths")   // Source path of an entry or alias → pathStamp
+)
+
+// pathStamp is the size, mtime and inode a catalogued path had when it was recorded.
+type pathStamp struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	Inode   uint64    `json:"inode,omitempty"` // zero if unknown
+}
+
+// Catalog is the persistent record of every backed-up file, keyed by content hash.
+// It is safe for concurrent use.
+type Catalog struct {
+	db *bolt.DB // nil for a read-only catalog whose file does not exist yet
+
+	mu sync.Mutex
+	// A read-only catalog keeps its changes here, so that a dry run sees what it would
+	// have recorded. They are lost on Close.
+	readOnly bool
+	entries  map[string]*CatalogEntry
+	paths    map[string]pathStamp
+}
+
+// OpenCatalog opens the catalog database at path, creating it if it does not exist.
+// A JSON catalog written by earlier versions, at path or at path with the extension
+// ".json", is imported and renamed to end in ".imported". With readOnly nothing is
+// written and changes are kept in memory, for dry runs. The database is locked while it
+// is open; another run waits a few seconds for it and then gives up.
+func OpenCatalog(path string, readOnly bool) (*Catalog, error) {
+	c := &Catalog{readOnly: readOnly}
+	if readOnly {
+		c.entries = make(map[string]*CatalogEntry)
+		c.paths = make(map[string]pathStamp)
+	}
+	if legacy := legacyCatalog(path); legacy != "" {
+		if readOnly {
+			entries, err := readJSONCatalog(legacy)
+			if err != nil {
+				return nil, err
+			}
+			for _, e := range entries {
+				catalogTx{c: c}.put(e)
+			}
+			return c, nil
+		}
+		if err := importJSONCatalog(legacy, path); err != nil {
+			return nil, fmt.Errorf("import %s: %w", legacy, err)
+		}
+		log.Printf("[INFO] Imported %s into %s and renamed it to %s.imported", legacy, path, filepath.Base(legacy))
+	}
+	if _, err := os.Stat(path); readOnly && errors.Is(err, os.ErrNotExist) {
+		return c, nil // no catalog yet
+	}
+	db, err := openCatalogDB(path, readOnly)
+	if err != nil {
+		return nil, err
+	}
+	c.db = db
+	return c, nil
+}
+
+// openCatalogDB opens the bbolt database at path and, unless readOnly, creates its buckets.
+func openCatalogDB(path string, readOnly bool) (*bolt.DB, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: 5 * time.Second, ReadOnly: readOnly})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, fmt.Errorf("%s is in use by another run", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if readOnly {
+		return db, nil
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{entriesBucket, pathsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// legacyCatalog returns the JSON catalog that the database at path replaces: path itself
+// if it holds JSON, or else the ".json" file next to it if path does not exist yet. It
+// returns "" if there is none.
+func legacyCatalog(path string) string {
+	if isJSONFile(path) {
+		return path
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		return ""
+	}
+	if legacy := strings.TrimSuffix(path, filepath.Ext(path)) + ".json"; legacy != path && isJSONFile(legacy) {
+		return legacy
+	}
+	return ""
+}
+
+// isJSONFile reports whether the file at path starts with a JSON object.
+func isJSONFile(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	return bytes.HasPrefix(bytes.TrimSpace(head[:n]), []byte("{"))
+}
+
+// readJSONCatalog reads the entries of a JSON catalog.
+func readJSONCatalog(path string) (map[string]*CatalogEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var legacy struct {
+		Entries map[string]*CatalogEntry `json:"entries"`
+	}
+	if err := json.NewDecoder(f).Decode(&legacy); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return legacy.Entries, nil
+}
+
+// importJSONCatalog writes the entries of the JSON catalog at legacy to a new database at
+// path, then renames legacy so that it is kept but not imported again.
+func importJSONCatalog(legacy, path string) error {
+	entries, err := readJSONCatalog(legacy)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".importing"
+	os.Remove(tmp) // left over from an import that failed
+	db, err := openCatalogDB(tmp, false)
+	if err != nil {
+		return err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		t := catalogTx{c: &Catalog{}, tx: tx}
+		for _, e := range entries {
+			if err := t.put(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if cerr := db.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(legacy, legacy+".imported")
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Close closes the database. The changes of a read-only catalog are discarded.
+func (c *Catalog) Close() error {
+	if c.db == nil {
+		return nil
+	}
+	return c.db.Close()
+}
+
+// catalogTx reads and writes the catalog within one transaction. Writes to a read-only
+// catalog go to its in-memory changes, which reads look at first.
+type catalogTx struct {
+	c  *Catalog
+	tx *bolt.Tx // nil if there is no database
+}
+
+// bucket returns the bucket called name, or nil if there is none.
+func (t catalogTx) bucket(name []byte) *bolt.Bucket {
+	if t.tx == nil {
+		return nil
+	}
+	return t.tx.Bucket(name)
+}
+
+// entry returns the entry for a content hash, or nil if there is none.
+func (t catalogTx) entry(sha256 string) (*CatalogEntry, error) {
+	if e, ok := t.c.entries[sha256]; ok {
+		return e, nil
+	}
+	b := t.bucket(entriesBucket)
+	if b == nil {
+		return nil, nil
+	}
+	v := b.Get([]byte(sha256))
+	if v == nil {
+		return nil, nil
+	}
+	var e CatalogEntry
+	if err := json.Unmarshal(v, &e); err != nil {
+		return nil, fmt.Errorf("catalog entry %s: %w", sha256, err)
+	}
+	return &e, nil
+}
+
+// stamp returns the stamp recorded for a source path.
+func (t catalogTx) stamp(path string) (pathStamp, bool) {
+	if st, ok := t.c.paths[path]; ok {
+		return st, true
+	}
+	b := t.bucket(pathsBucket)
+	if b == nil {
+		return pathStamp{}, false
+	}
+	var st pathStamp
+	v := b.Get([]byte(path))
+	if v == nil || json.Unmarshal(v, &st) != nil {
+		return pathStamp{}, false
+	}
+	return st, true
+}
+
+// put writes e, replacing any entry with the same content hash, and the stamps of its
+// source path and aliases.
+func (t catalogTx) put(e *CatalogEntry) error {
+	stamps := map[string]pathStamp{e.SourcePath: {e.Size, e.ModTime, e.Inode}}
+	for _, a := range e.Aliases {
+		stamps[a.Path] = pathStamp{e.Size, a.ModTime, a.Inode}
+	}
+	if t.c.readOnly {
+		t.c.entries[e.SHA256] = e
+		for path, st := range stamps {
+			t.c.paths[path] = st
+		}
+		return nil
+	}
+	v, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if err := t.tx.Bucket(entriesBucket).Put([]byte(e.SHA256), v); err != nil {
+		return err
+	}
+	for path, st := range stamps {
+		v, err := json.Marshal(st)
+		if err != nil {
+			return err
+		}
+		if err := t.tx.Bucket(pathsBucket).Put([]byte(path), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addAlias records path, stamped st, as another copy of e and writes e.
+func (t catalogTx) addAlias(e *CatalogEntry, path string, st pathStamp) error {
+	if path == e.SourcePath {
+		e.ModTime, e.Inode = st.ModTime, st.Inode
+		return t.put(e)
+	}
+	for i := range e.Aliases {
+		if e.Aliases[i].Path == path {
+			e.Aliases[i].ModTime, e.Aliases[i].Inode = st.ModTime, st.Inode
+			return t.put(e)
+		}
+	}
+	e.Aliases = append(e.Aliases, CatalogAlias{Path: path, ModTime: st.ModTime, Inode: st.Inode})
+	return t.put(e)
+}
+
+// view runs fn in a read transaction.
+func (c *Catalog) view(fn func(catalogTx) error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.db == nil {
+		return fn(catalogTx{c: c})
+	}
+	return c.db.View(func(tx *bolt.Tx) error { return fn(catalogTx{c, tx}) })
+}
+
+// update runs fn in a write transaction, which is committed if fn returns nil.
+func (c *Catalog) update(fn func(catalogTx) error) error {
+	if c.readOnly {
+		return c.view(fn)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.db.Update(func(tx *bolt.Tx) error { return fn(catalogTx{c, tx}) })
+}
+
+// Len returns the number of entries.
+func (c *Catalog) Len() int {
+	n := 0
+	c.view(func(t catalogTx) error {
+		b := t.bucket(entriesBucket)
+		if b != nil {
+			n = b.Stats().KeyN
+		}
+		for sha := range c.entries {
+			if b == nil || b.Get([]byte(sha)) == nil {
+				n++
+			}
+		}
+		return nil
+	})
+	return n
+}
+
+// ForEach calls fn for every entry and stops at the first error, which it returns. fn
+// must not call other methods of the catalog.
+func (c *Catalog) ForEach(fn func(*CatalogEntry) error) error {
+	return c.view(func(t catalogTx) error {
+		if b := t.bucket(entriesBucket); b != nil {
+			err := b.ForEach(func(k, v []byte) error {
+				if _, ok := c.entries[string(k)]; ok {
+					return nil // changed in memory; visited below
+				}
+				var e CatalogEntry
+				if err := json.Unmarshal(v, &e); err != nil {
+					return fmt.Errorf("catalog entry %s: %w", k, err)
+				}
+				return fn(&e)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		for _, e := range c.entries {
+			if err := fn(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Lookup returns the entry for a content hash.
+func (c *Catalog) Lookup(sha256 string) (*CatalogEntry, bool) {
+	var e *CatalogEntry
+	c.view(func(t catalogTx) error {
+		var err error
+		e, err = t.entry(sha256)
+		return err
+	})
+	return e, e != nil
+}
+
+// Unchanged reports whether path is catalogued with the given size, modification time
+// and (where known) inode, i.e. the file was backed up and has not changed since.
+func (c *Catalog) Unchanged(path string, info os.FileInfo) bool {
+	var st pathStamp
+	var ok bool
+	c.view(func(t catalogTx) error {
+		st, ok = t.stamp(path)
+		return nil
+	})
+	if !ok || st.Size != info.Size() || !st.ModTime.Equal(info.ModTime()) {
+		return false
+	}
+	inode, _, _ := fileIdentity(info)
+	return st.Inode == 0 || inode == 0 || st.Inode == inode
+}
+
+// Add records e, replacing any entry with the same content hash.
+func (c *Catalog) Add(e *CatalogEntry) error {
+	return c.update(func(t catalogTx) error { return t.put(e) })
+}
+
+// ArchiveAliases returns the alias paths of the files stored in the archive at key, by
+// member, for RestoreArchive. Aliases found by runs after the archive was written are
+// only recorded here, not in the archive's manifest.
+func (c *Catalog) ArchiveAliases(key string) (map[string][]string, error) {
+	aliases := make(map[string][]string)
+	err := c.ForEach(func(e *CatalogEntry) error {
+		if e.Key != key {
+			return nil
+		}
+		for _, a := range e.Aliases {
+			aliases[e.Member] = append(aliases[e.Member], a.Path)
+		}
+		return nil
+	})
+	return aliases, err
+}
+
+// AddAlias records path, described by info, as another copy of the catalogued content
+// sha256 and reports whether that content is catalogued. The existing archive location is kept.
+func (c *Catalog) AddAlias(sha256, path string, info os.FileInfo) (bool, error) {
+	inode, _, _ := fileIdentity(info)
+	known := false
+	err := c.update(func(t catalogTx) error {
+		e, err := t.entry(sha256)
+		if e == nil || err != nil {
+			return err
+		}
+		known = true
+		return t.addAlias(e, path, pathStamp{e.Size, info.ModTime(), inode})
+	})
+	return known, err
+}
+
+// AddManifest records every file of an uploaded archive, with its duplicates as aliases,
+// in one transaction. Sidecars are stored with their photo even if their content is
+// already catalogued; those are recorded as aliases of the existing entry.
+func (c *Catalog) AddManifest(m *Manifest, key, storageClass string, uploaded time.Time) error {
+	inodes := make([]uint64, len(m.Files))
+	for i, f := range m.Files {
+		if info, err := os.Stat(f.Path); err == nil && info.Size() == f.Size && info.ModTime().Equal(f.ModTime) {
+			inodes[i], _, _ = fileIdentity(info)
+		}
+	}
+	return c.update(func(t catalogTx) error {
+		for i, f := range m.Files {
+			if f.Meta.Primary != "" {
+				added, err := addSidecarAlias(t, f, inodes[i])
+				if err != nil {
+					return err
+				}
+				if added {
+					continue
+				}
+			}
+			var aliases []CatalogAlias
+			for _, dup := range f.Duplicates {
+				aliases = append(aliases, CatalogAlias{Path: dup}) // mtime is filled in when next seen
+			}
+			err := t.put(&CatalogEntry{
+				SHA256:       f.SHA256,
+				SourcePath:   f.Path,
+				Size:         f.Size,
+				ModTime:      f.ModTime,
+				Inode:        inodes[i],
+				Meta:         f.Meta,
+				Archive:      m.Archive,
+				Member:       f.Member,
+				Key:          key,
+				StorageClass: storageClass,
+				Uploaded:     uploaded,
+				Aliases:      aliases,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// addSidecarAlias records the sidecar f as another copy of an entry with the same
+// content under a different path and reports whether there is one.
+func addSidecarAlias(t catalogTx, f ManifestEntry, inode uint64) (bool, error) {
+	e, err := t.entry(f.SHA256)
+	if e == nil || err != nil || e.SourcePath == f.Path {
+		return false, err
+	}
+	return true, t.addAlias(e, f.Path, pathStamp{e.Size, f.ModTime, inode})
+}
+
+// SeedCatalog records the files of scan, a scan of an empty catalog, that the previous
+// last-upload-time model backed up: files taken before since that were already present
+// at that time, judged by their status change time (or mtime where unavailable), so
+// photos of any date imported after since stay new. Sidecars are recorded only with
+// their photo, and identical copies as its aliases. The model kept no record of where it
+// stored a file, so the entries have no archive location; verify and prune report them
+// as unconfirmed. It returns the number of files recorded.
+func SeedCatalog(c *Catalog, scan ScanResult, since time.Time) (int, error) {
+	seeded := make(map[string]bool)
+	stamp := func(path string) (pathStamp, bool) {
+		info, err := os.Stat(path)
+		if err != nil || info.ModTime().After(since) {
+			return pathStamp{}, false
+		}
+		inode, ctime, ok := fileIdentity(info)
+		if ok && ctime.After(since) {
+			return pathStamp{}, false
+		}
+		return pathStamp{info.Size(), info.ModTime(), inode}, true
+	}
+	err := c.update(func(t catalogTx) error {
+		for _, f := range scan.Files {
+			if f.Taken.After(since) || (f.Primary != "" && !seeded[f.Primary]) {
+				continue
+			}
+			st, ok := stamp(f.Path)
+			if !ok {
+				continue
+			}
+			e := &CatalogEntry{SHA256: f.SHA256, SourcePath: f.Path, Size: st.Size, ModTime: st.ModTime, Inode: st.Inode, Meta: f}
+			if err := t.put(e); err != nil {
+				return err
+			}
+			seeded[f.Path] = true
+			for _, dup := range scan.Duplicates[f.Path] {
+				if st, ok := stamp(dup); ok {
+					if err := t.addAlias(e, dup, st); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(seeded), nil
+}
+
+// Seeded reports whether e was recorded by SeedCatalog, and so is not confirmed to be in
+// any archive.
+func (e *CatalogEntry) Seeded() bool { return e.Key == "" }
@@ -0,0 +1,192 @@
+package photosbackup
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// openTestCatalog opens an empty catalog that is closed when the test ends.
+func openTestCatalog(t *testing.T) *Catalog {
+	t.Helper()
+	c, err := OpenCatalog(filepath.Join(t.TempDir(), "catalog.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestCatalogSkipsBackedUpFiles(t *testing.T) {
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a.jpg"), filepath.Join(dir, "b.jpg")
+	os.WriteFile(a, []byte("photo a"), 0644)
+	os.WriteFile(b, []byte("photo b"), 0644)
+
+	catalogPath := filepath.Join(t.TempDir(), "catalog.db")
+	c, err := OpenCatalog(catalogPath, false)
+	if err != nil || c.Len() != 0 {
+		t.Fatalf("OpenCatalog on missing file = %v, %v", c, err)
+	}
+	m, err := WriteZip(io.Discard, "2024-01_20240201T120000.zip", []PhotoMeta{{Path: a}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.AddManifest(m, "2024/2024-01_20240201T120000.zip", "GLACIER", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	c, err = OpenCatalog(catalogPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	e, ok := c.Lookup(m.Files[0].SHA256)
+	if !ok || e.SourcePath != a || e.Key != "2024/2024-01_20240201T120000.zip" || e.StorageClass != "GLACIER" {
+		t.Fatalf("Lookup returned %+v, %v", e, ok)
+	}
+
+	opts := ScanOptions{AllowedExtensions: []string{".jpg"}, Catalog: c}
+	files := scanLibrary(t, dir, opts).Files
+	if len(files) != 1 || files[0].Path != b {
+		t.Errorf("expected only b.jpg to be new, got %v", files)
+	}
+
+	// A touched file with the same content is not, but an edited one is backed up again
+	later := time.Now().Add(time.Hour)
+	os.Chtimes(a, later, later)
+	if files = scanLibrary(t, dir, opts).Files; len(files) != 1 {
+		t.Errorf("expected touched a.jpg to stay backed up, got %v", files)
+	}
+	os.WriteFile(a, []byte("edited photo a"), 0644)
+	if files = scanLibrary(t, dir, opts).Files; len(files) != 2 {
+		t.Errorf("expected edited a.jpg to be new again, got %v", files)
+	}
+}
+
+func TestFindNewPhotosDeduplicatesByContent(t *testing.T) {
+	ctx := context.Background()
+	b, err := NewLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	os.WriteFile(dir+"/IMG_1.jpg", []byte("same bytes"), 0644)
+	os.WriteFile(dir+"/IMG_1 (edited import).jpg", []byte("same bytes"), 0644)
+	os.WriteFile(dir+"/IMG_2.jpg", []byte("other bytes"), 0644)
+	c := openTestCatalog(t)
+	opts := ScanOptions{AllowedExtensions: []string{".jpg"}, Catalog: c}
+
+	// Identical files within one run are stored once and listed as duplicates
+	res := scanLibrary(t, dir, opts)
+	if len(res.Files) != 2 || len(res.Duplicates[dir+"/IMG_1 (edited import).jpg"]) != 1 {
+		t.Fatalf("expected 2 distinct files and 1 duplicate, got %+v", res)
+	}
+	key := "2024/2024-05_20240601T120000.zip"
+	_, m, err := UploadZip(ctx, b, key, res.Files, res.Duplicates, PutOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.AddManifest(m, key, "", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Later copies of backed-up content are recorded as aliases, not uploaded again
+	os.WriteFile(dir+"/copy of IMG_2.jpg", []byte("other bytes"), 0644)
+	res = scanLibrary(t, dir, opts)
+	if len(res.Files) != 0 || res.Known != 2 {
+		t.Errorf("expected no new files and 2 known copies, got %+v", res)
+	}
+	if len(scanLibrary(t, dir, opts).Files) != 0 {
+		t.Error("aliases should be skipped on later runs")
+	}
+
+	// Restores recreate every copy from the single stored member, including the one
+	// found after the archive was written
+	dest := t.TempDir()
+	var stats RestoreStats
+	aliases, err := c.ArchiveAliases(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := RestoreArchive(ctx, b, key, dest, dir, aliases, &stats); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(dest + "/IMG_1.jpg"); string(got) != "same bytes" || stats.Restored != 4 {
+		t.Errorf("restore did not recreate duplicates: %+v", stats)
+	}
+	if got, _ := os.ReadFile(dest + "/copy of IMG_2.jpg"); string(got) != "other bytes" {
+		t.Errorf("later copy restored as %q", got)
+	}
+}
+
+func TestLateImportedOldPhotoIsNew(t *testing.T) {
+	dir := t.TempDir()
+	lastUpload := time.Now().Add(-time.Hour)
+	c := openTestCatalog(t)
+
+	// A photo from 2014 imported after the last upload keeps its old mtime
+	path := filepath.Join(dir, "IMG_2014.jpg")
+	os.WriteFile(path, []byte("taken in 2014"), 0644)
+	taken := time.Date(2014, 6, 15, 12, 0, 0, 0, time.Local)
+	os.Chtimes(path, taken, taken)
+
+	opts := ScanOptions{AllowedExtensions: []string{".jpg"}, Catalog: c}
+	if n, err := SeedCatalog(c, scanLibrary(t, dir, opts), lastUpload); err != nil || n != 0 {
+		t.Errorf("late import must not be seeded as backed up, seeded %d", n)
+	}
+	res := scanLibrary(t, dir, opts)
+	if len(res.Files) != 1 {
+		t.Fatalf("expected the 2014 photo to be new, got %v", res.Files)
+	}
+	if groups := GroupPhotosByYearMonth(res.Files, nil); len(groups["2014-06"]) != 1 {
+		t.Errorf("expected the photo in the 2014-06 archive, got %v", groups)
+	}
+}
+
+func TestOpenCatalogImportsJSON(t *testing.T) {
+	dir := t.TempDir()
+	legacy, path := filepath.Join(dir, "catalog.json"), filepath.Join(dir, "catalog.db")
+	os.WriteFile(legacy, []byte(`{"entries": {"abc": {"sha256": "abc", "source_path": "/lib/a.jpg", "size": 7, "key": "2024/2024-01_20240201T120000.zip"}}}`), 0644)
+
+	// A dry run reads the JSON catalog and writes nothing
+	dry, err := OpenCatalog(path, true)
+	if err != nil || dry.Len() != 1 {
+		t.Fatalf("read-only OpenCatalog = %v, %v", dry, err)
+	}
+	dry.Add(&CatalogEntry{SHA256: "def", SourcePath: "/lib/b.jpg"})
+	if _, ok := dry.Lookup("def"); !ok || dry.Len() != 2 {
+		t.Errorf("read-only catalog lost an entry added in memory")
+	}
+	dry.Close()
+	if _, err := os.Stat(path); err == nil {
+		t.Errorf("a dry run created %s", path)
+	}
+
+	c, err := OpenCatalog(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, ok := c.Lookup("abc"); !ok || e.SourcePath != "/lib/a.jpg" || c.Len() != 1 {
+		t.Errorf("imported entry %+v, %d entries", e, c.Len())
+	}
+	if _, err := os.Stat(legacy + ".imported"); err != nil {
+		t.Errorf("JSON catalog not renamed: %v", err)
+	}
+	c.Close()
+
+	// Changes of a dry run on the database are not written either
+	if dry, err = OpenCatalog(path, true); err != nil {
+		t.Fatal(err)
+	}
+	dry.Add(&CatalogEntry{SHA256: "def", SourcePath: "/lib/b.jpg"})
+	dry.Close()
+	if c, err = OpenCatalog(path, false); err != nil || c.Len() != 1 {
+		t.Errorf("after a dry run: %v entries, %v", c.Len(), err)
+	}
+	c.Close()
+}
@@ -0,0 +1,150 @@
+package photosbackup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// ArchiveChecksum is the SHA256 checksum of an archive in the forms S3 reports it:
+// a full-object digest for single-part uploads and a composite digest
+// (SHA256 of the concatenated part digests, suffixed with "-<parts>") for multipart uploads.
+type ArchiveChecksum struct {
+	SHA256    string // Hex digest of the whole archive
+	Full      string // Base64 digest of the whole archive
+	Composite string // Base64 composite digest with "-<parts>" suffix
+	Parts     int
+	Size      int64
+}
+
+// checksumWriter computes an ArchiveChecksum for data written to it, splitting
+// it into parts of partSize bytes. A partSize of zero disables the composite digest.
+type checksumWriter struct {
+	partSize int64
+	full     hash.Hash
+	part     hash.Hash
+	partLen  int64
+	partSums []byte
+	parts    int
+	size     int64
+}
+
+func newChecksumWriter(partSize int64) *checksumWriter {
+	return &checksumWriter{partSize: partSize, full: sha256.New(), part: sha256.New()}
+}
+
+func (c *checksumWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	c.full.Write(p)
+	c.size += int64(n)
+	for c.partSize > 0 && len(p) > 0 {
+		chunk := p
+		if room := c.partSize - c.partLen; int64(len(chunk)) > room {
+			chunk = chunk[:room]
+		}
+		c.part.Write(chunk)
+		c.partLen += int64(len(chunk))
+		p = p[len(chunk):]
+		if c.partLen == c.partSize {
+			c.endPart()
+		}
+	}
+	return n, nil
+}
+
+func (c *checksumWriter) endPart() {
+	c.partSums = c.part.Sum(c.partSums)
+	c.parts++
+	c.part.Reset()
+	c.partLen = 0
+}
+
+// Sum returns the checksum of everything written so far.
+func (c *checksumWriter) Sum() ArchiveChecksum {
+	full := c.full.Sum(nil)
+	sum := ArchiveChecksum{
+		SHA256: fmt.Sprintf("%x", full),
+		Full:   base64.StdEncoding.EncodeToString(full),
+		Size:   c.size,
+	}
+	if c.partSize > 0 {
+		sums, parts := c.partSums, c.parts
+		if c.partLen > 0 || parts == 0 {
+			sums = c.part.Sum(append([]byte(nil), sums...))
+			parts++
+		}
+		composite := sha256.Sum256(sums)
+		sum.Composite = base64.StdEncoding.EncodeToString(composite[:]) + "-" + strconv.Itoa(parts)
+		sum.Parts = parts
+	}
+	return sum
+}
+
+// errPartCount is returned by Verify when the backend's composite checksum has a different
+// number of parts than the local one, so the two cannot be compared.
+var errPartCount = errors.New("different part size")
+
+// Verify compares c with a checksum reported by the backend.
+func (c ArchiveChecksum) Verify(remote string) error {
+	if remote == "" {
+		return fmt.Errorf("no SHA256 checksum recorded for object")
+	}
+	if i := strings.LastIndex(remote, "-"); i >= 0 {
+		parts, _ := strconv.Atoi(remote[i+1:])
+		if c.Composite == "" || parts != c.Parts {
+			return fmt.Errorf("object was uploaded in %d parts, local checksum has %d: %w", parts, c.Parts, errPartCount)
+		}
+		if remote != c.Composite {
+			return fmt.Errorf("checksum mismatch: local %s, remote %s", c.Composite, remote)
+		}
+		return nil
+	}
+	if remote != c.Full {
+		return fmt.Errorf("checksum mismatch: local %s, remote %s", c.Full, remote)
+	}
+	return nil
+}
+
+// VerifyUpload checks the checksum the backend recorded for key against sum,
+// using object metadata only so no storage class requires a download.
+func VerifyUpload(ctx context.Context, b Backend, key string, sum ArchiveChecksum) error {
+	info, err := b.Head(ctx, key)
+	if err != nil {
+		return err
+	}
+	if info.Size != sum.Size {
+		return fmt.Errorf("size mismatch: local %d, remote %d", sum.Size, info.Size)
+	}
+	return sum.Verify(info.ChecksumSHA256)
+}
+
+// objectPartSize returns the part size the object at key was uploaded with, asking the
+// backend where it can tell and assuming the current upload part size otherwise.
+func objectPartSize(ctx context.Context, b Backend, key string) int64 {
+	partSize := uploadPartSize(b)
+	if ps, ok := b.(interface {
+		ObjectPartSize(context.Context, string) (int64, error)
+	}); ok {
+		size, err := ps.ObjectPartSize(ctx, key)
+		if err != nil {
+			log.Printf("[WARN] Could not read the part size of %s, assuming %d bytes: %v", key, partSize, err)
+		} else if size > 0 {
+			partSize = size
+		}
+	}
+	return partSize
+}
+
+// uploadPartSize returns the part size b splits uploads into, or zero for single-part backends.
+func uploadPartSize(b Backend) int64 {
+	if ps, ok := b.(interface{ UploadPartSize() int64 }); ok {
+		return ps.UploadPartSize()
+	}
+	return 0
+}
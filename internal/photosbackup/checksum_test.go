@@ -0,0 +1,59 @@
+package photosbackup
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"testing"
+)
+
+func TestChecksumWriterComposite(t *testing.T) {
+	cw := newChecksumWriter(3)
+	cw.Write([]byte("abcd"))
+	cw.Write([]byte("efgh"))
+	sum := cw.Sum()
+
+	var parts []byte
+	for _, p := range []string{"abc", "def", "gh"} {
+		d := sha256.Sum256([]byte(p))
+		parts = append(parts, d[:]...)
+	}
+	composite := sha256.Sum256(parts)
+	want := base64.StdEncoding.EncodeToString(composite[:]) + "-3"
+	if sum.Composite != want || sum.Parts != 3 || sum.Size != 8 {
+		t.Fatalf("got %+v, want composite %s", sum, want)
+	}
+
+	full := sha256.Sum256([]byte("abcdefgh"))
+	if err := sum.Verify(base64.StdEncoding.EncodeToString(full[:])); err != nil {
+		t.Errorf("full checksum should verify: %v", err)
+	}
+	if err := sum.Verify(want); err != nil {
+		t.Errorf("composite checksum should verify: %v", err)
+	}
+	if err := sum.Verify("AAAA-3"); err == nil {
+		t.Error("expected mismatch for wrong composite checksum")
+	}
+	if err := sum.Verify(want[:len(want)-1] + "4"); err == nil {
+		t.Error("expected error for different part count")
+	}
+	if err := sum.Verify(""); err == nil {
+		t.Error("expected error when backend reports no checksum")
+	}
+}
+
+func TestArchivePartSize(t *testing.T) {
+	const mib = 1 << 20
+	if got := ArchivePartSize(10<<30, 5*mib); got != 5*mib {
+		t.Errorf("10 GiB: part size %d, want the 5 MiB minimum", got)
+	}
+	// 5 MiB parts stop at about 48.8 GiB
+	for _, bytes := range []int64{50 << 30, 400 << 30, 2 << 40} {
+		got := ArchivePartSize(bytes, 5*mib)
+		if got%mib != 0 || got*maxUploadParts < bytes+bytes/100+64*mib {
+			t.Errorf("%d bytes: part size %d does not fit in %d parts", bytes, got, maxUploadParts)
+		}
+	}
+	if got := ArchivePartSize(400<<30, 64*mib); got != 64*mib {
+		t.Errorf("400 GiB with 64 MiB parts: got %d", got)
+	}
+}
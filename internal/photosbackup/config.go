@@ -0,0 +1,204 @@
+package photosbackup
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// Defaults of settings that are left unset.
+const (
+	defaultKeyFormat            = "{year}/{zip}"
+	defaultMaxConcurrentUploads = 8
+	minUploadPartSizeMB         = 5 // S3 rejects smaller parts, except the last one
+)
+
+// logLevels are the values of log_level.
+var logLevels = []string{"debug", "info", "warn", "error"}
+
+// ApplyDefaults fills in the settings that are left unset and spells storage_class the
+// way S3 expects it.
+func (c *Config) ApplyDefaults() {
+	if c.S3KeyFormat == "" {
+		c.S3KeyFormat = defaultKeyFormat
+	}
+	if c.MaxConcurrentUploads == 0 {
+		c.MaxConcurrentUploads = defaultMaxConcurrentUploads
+	}
+	if c.UploadPartSizeMB == 0 {
+		c.UploadPartSizeMB = minUploadPartSizeMB
+	}
+	if c.CatalogFile == "" {
+		c.CatalogFile = "catalog.db"
+	}
+	if c.ScanCacheFile == "" {
+		c.ScanCacheFile = "scan_cache.json"
+	}
+	if c.Hostname == "" {
+		c.Hostname = defaultHostname()
+	}
+	if c.isS3() {
+		if c.StorageClass == "" {
+			c.StorageClass = string(types.StorageClassStandard)
+		}
+		for _, class := range types.StorageClass("").Values() {
+			if strings.EqualFold(c.StorageClass, string(class)) {
+				c.StorageClass = string(class)
+			}
+		}
+	}
+}
+
+func (c *Config) isS3() bool {
+	t := strings.ToLower(c.Backend.Type)
+	return t == "" || t == "s3"
+}
+
+// Validate applies the defaults and checks the config, including that the source
+// directories exist. It reports every problem, one per line, rather than the first.
+func (c *Config) Validate() error {
+	return c.validate(true)
+}
+
+// validate is Validate, optionally without looking at the source directories: restores
+// and listings do not read them, and may run on a machine that has none.
+func (c *Config) validate(checkPaths bool) error {
+	c.ApplyDefaults()
+	var errs []error
+	problem := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	switch {
+	case c.isS3():
+		if c.S3Bucket == "" {
+			problem("s3_bucket is required for the s3 backend (or set backend.type: local)")
+		}
+		if !validStorageClass(c.StorageClass) {
+			problem("storage_class: unknown class %q, want one of %s", c.StorageClass, joinStorageClasses())
+		}
+	case strings.EqualFold(c.Backend.Type, "local"):
+		if c.Backend.Path == "" {
+			problem("backend.path is required for the local backend")
+		}
+	default:
+		problem("backend.type: unknown type %q, want s3 or local", c.Backend.Type)
+	}
+	if c.MaxConcurrentUploads < 0 {
+		problem("max_concurrent_uploads: %d is negative; leave it unset for %d", c.MaxConcurrentUploads, defaultMaxConcurrentUploads)
+	}
+	if c.UploadPartSizeMB < minUploadPartSizeMB {
+		problem("upload_part_size_mb: %d is below the S3 minimum of %d", c.UploadPartSizeMB, minUploadPartSizeMB)
+	}
+	if c.ScanWorkers < 0 {
+		problem("scan_workers: %d is negative; leave it unset for one per CPU", c.ScanWorkers)
+	}
+	if c.TestModeLimit < 0 {
+		problem("test_mode_limit: %d is negative", c.TestModeLimit)
+	}
+	if c.StoragePricePerGB < 0 {
+		problem("storage_price_per_gb: %v is negative", c.StoragePricePerGB)
+	}
+	if c.LogLevel != "" && !containsFold(logLevels, c.LogLevel) {
+		problem("log_level: unknown level %q, want one of %s", c.LogLevel, strings.Join(logLevels, ", "))
+	}
+	keys, err := c.keyTemplate()
+	if err != nil {
+		errs = append(errs, err)
+	} else if keys.uses("hostname") && c.Hostname == "" {
+		problem("hostname: the name of this machine is unknown; set it for {hostname} in s3_key_format")
+	}
+
+	if sources, err := c.BackupSources(); err != nil {
+		errs = append(errs, err)
+	} else {
+		if _, err := CompileRules(c.Rules); err != nil {
+			errs = append(errs, err)
+		}
+		for i, src := range sources {
+			if src.KeyPrefix != "" {
+				if err := checkKey(strings.TrimSuffix(src.KeyPrefix, "/")); err != nil {
+					problem("sources[%d]: key_prefix: %v", i, err)
+				}
+			}
+			// Render a key to find values, such as a source name, that do not fit in keys
+			if keys != nil {
+				if _, err := src.ArchiveKey(c, "2024-06_20240701T153000.zip", "Camera"); err != nil {
+					err = fmt.Errorf("s3_key_format: %w", err)
+					if src.Name != "" {
+						err = fmt.Errorf("sources[%d]: %w", i, err)
+					}
+					errs = append(errs, err)
+				}
+			}
+			if len(src.Rules) > len(c.Rules) {
+				if _, err := CompileRules(src.Rules[:len(src.Rules)-len(c.Rules)]); err != nil {
+					errs = append(errs, fmt.Errorf("sources[%d]: %w", i, err))
+				}
+			}
+			if !checkPaths {
+				continue
+			}
+			if err := checkSourcePath(src); err != nil {
+				if src.Name != "" {
+					err = fmt.Errorf("sources[%d]: %w", i, err)
+				}
+				errs = append(errs, err)
+			}
+		}
+	}
+	if _, err := c.DefaultZone(); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := c.BucketZone(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// checkSourcePath returns an error if the directory of src does not exist.
+func checkSourcePath(src Source) error {
+	key := "photos_library_path"
+	if src.Name != "" {
+		key = "path"
+	}
+	info, err := os.Stat(src.Path)
+	switch {
+	case os.IsNotExist(err):
+		return fmt.Errorf("%s: %s does not exist", key, src.Path)
+	case err != nil:
+		return fmt.Errorf("%s: %w", key, err)
+	case !info.IsDir():
+		return fmt.Errorf("%s: %s is not a directory", key, src.Path)
+	}
+	return nil
+}
+
+func validStorageClass(class string) bool {
+	for _, c := range types.StorageClass("").Values() {
+		if string(c) == class {
+			return true
+		}
+	}
+	return false
+}
+
+func joinStorageClasses() string {
+	var names []string
+	for _, c := range types.StorageClass("").Values() {
+		names = append(names, string(c))
+	}
+	return strings.Join(names, ", ")
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
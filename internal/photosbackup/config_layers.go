@@ -0,0 +1,272 @@
+package photosbackup
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Settings are read from, in increasing precedence: the defaults, the config file, the
+// environment and the command line. Each setting is taken from the last layer that sets
+// it, so a cron job or container can keep one file and override a few values.
+
+// EnvPrefix starts the names of environment variables that set a setting, e.g.
+// PHOTOS_BACKUP_STORAGE_CLASS. PHOTOS_BACKUP_CONFIG names the config file.
+const EnvPrefix = "PHOTOS_BACKUP_"
+
+// ConfigEnv is the environment variable naming the config file.
+const ConfigEnv = EnvPrefix + "CONFIG"
+
+// DefaultConfigFile is read if no config file is given and it exists.
+const DefaultConfigFile = "config.yaml"
+
+// Setting is a config field that can be given in the config file, the environment and
+// on the command line.
+type Setting struct {
+	Key   string // As in the config file, e.g. "backend.type"
+	Env   string // Environment variable, e.g. "PHOTOS_BACKUP_BACKEND_TYPE"
+	Flag  string // Command-line flag without dashes, e.g. "backend-type"
+	Bool  bool   // The flag may be given without a value
+	index []int
+}
+
+// Settings returns every setting of Config in file order. Settings of nested sections,
+// such as backend, are listed one by one.
+func Settings() []Setting {
+	return appendSettings(nil, reflect.TypeOf(Config{}), "", nil)
+}
+
+func appendSettings(settings []Setting, t reflect.Type, prefix string, index []int) []Setting {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		idx := append(append([]int(nil), index...), i)
+		if f.Type.Kind() == reflect.Struct {
+			settings = appendSettings(settings, f.Type, prefix+name+".", idx)
+			continue
+		}
+		key := prefix + name
+		settings = append(settings, Setting{
+			Key:   key,
+			Env:   EnvPrefix + strings.ToUpper(strings.NewReplacer(".", "_").Replace(key)),
+			Flag:  strings.NewReplacer(".", "-", "_", "-").Replace(key),
+			Bool:  f.Type.Kind() == reflect.Bool,
+			index: idx,
+		})
+	}
+	return settings
+}
+
+// Set sets the setting in c from its text form. Strings are taken as they are; other
+// values are YAML, such as "25", "true", "[.jpg, .heic]" or
+// "[{action: exclude, glob: '**/Drafts/**'}]".
+func (s Setting) Set(c *Config, value string) error {
+	f := reflect.ValueOf(c).Elem().FieldByIndex(s.index)
+	if f.Kind() == reflect.String {
+		f.SetString(value)
+		return nil
+	}
+	v := reflect.New(f.Type())
+	dec := yaml.NewDecoder(strings.NewReader(value))
+	dec.KnownFields(true)
+	if err := dec.Decode(v.Interface()); err != nil && err != io.EOF {
+		return err
+	}
+	f.Set(v.Elem())
+	return nil
+}
+
+// Format returns the value of the setting in c as YAML on one line, leaving out empty
+// fields of sources and rules. Unset strings and lists are "".
+func (s Setting) Format(c *Config) string {
+	f := reflect.ValueOf(c).Elem().FieldByIndex(s.index)
+	switch f.Kind() {
+	case reflect.String:
+		return f.String()
+	case reflect.Slice:
+		if f.Len() == 0 {
+			return ""
+		}
+	}
+	var node yaml.Node
+	if err := node.Encode(f.Interface()); err != nil {
+		return fmt.Sprint(f.Interface())
+	}
+	compactNode(&node)
+	b, err := yaml.Marshal(&node)
+	if err != nil {
+		return fmt.Sprint(f.Interface())
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// isSet reports whether the setting in c has a value other than the zero value.
+func (s Setting) isSet(c *Config) bool {
+	return !reflect.ValueOf(c).Elem().FieldByIndex(s.index).IsZero()
+}
+
+// compactNode puts n on one line and drops the empty values of its mappings.
+func compactNode(n *yaml.Node) {
+	n.Style |= yaml.FlowStyle
+	if n.Kind == yaml.MappingNode {
+		var content []*yaml.Node
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			v := n.Content[i+1]
+			empty := v.Tag == "!!null" || (v.Kind == yaml.ScalarNode && v.Tag == "!!str" && v.Value == "") ||
+				(v.Kind != yaml.ScalarNode && len(v.Content) == 0)
+			if !empty {
+				content = append(content, n.Content[i], v)
+			}
+		}
+		n.Content = content
+	}
+	for _, c := range n.Content {
+		compactNode(c)
+	}
+}
+
+// ConfigLayers are the places a config is read from besides the defaults.
+type ConfigLayers struct {
+	// File is the config file. If empty, $PHOTOS_BACKUP_CONFIG is read, or else
+	// config.yaml if it exists.
+	File  string
+	Env   []string          // Environment in the form of os.Environ
+	Flags map[string]string // Values given on the command line, by setting key
+}
+
+// ConfigFile returns the config file to read, and whether it has to exist.
+func (l ConfigLayers) ConfigFile() (string, bool) {
+	if l.File != "" {
+		return l.File, true
+	}
+	for _, kv := range l.Env {
+		if k, v, _ := strings.Cut(kv, "="); k == ConfigEnv && v != "" {
+			return v, true
+		}
+	}
+	return DefaultConfigFile, false
+}
+
+// Origins maps the key of each setting to where its value came from: "default",
+// "file config.yaml", "env PHOTOS_BACKUP_REGION" or "flag --region". Settings that
+// are unset everywhere and have no default are missing.
+type Origins map[string]string
+
+// ResolveConfig builds the config from its layers and applies the defaults. Unknown
+// keys in the file, unknown PHOTOS_BACKUP_ variables and values that do not parse are
+// errors; Validate checks the result.
+func ResolveConfig(layers ConfigLayers) (*Config, Origins, error) {
+	env := make(map[string]string)
+	for _, kv := range layers.Env {
+		if k, v, ok := strings.Cut(kv, "="); ok && strings.HasPrefix(k, EnvPrefix) {
+			env[k] = v
+		}
+	}
+	settings := Settings()
+	cfg := &Config{}
+	origins := make(Origins)
+
+	path, required := layers.ConfigFile()
+	b, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		keys, err := decodeConfig(b, cfg, settings)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", path, err)
+		}
+		for _, key := range keys {
+			origins[key] = "file " + path
+		}
+	case required || !errors.Is(err, os.ErrNotExist):
+		return nil, nil, err
+	}
+
+	var errs []error
+	known := map[string]bool{ConfigEnv: true}
+	for _, s := range settings {
+		known[s.Env] = true
+		if v, ok := env[s.Env]; ok {
+			if err := s.Set(cfg, v); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", s.Env, err))
+			}
+			origins[s.Key] = "env " + s.Env
+		}
+	}
+	var unknown []string
+	for k := range env {
+		if !known[k] {
+			unknown = append(unknown, k)
+		}
+	}
+	sort.Strings(unknown)
+	for _, k := range unknown {
+		errs = append(errs, fmt.Errorf("%s is not a setting", k))
+	}
+	for _, s := range settings {
+		if v, ok := layers.Flags[s.Key]; ok {
+			if err := s.Set(cfg, v); err != nil {
+				errs = append(errs, fmt.Errorf("--%s: %w", s.Flag, err))
+			}
+			origins[s.Key] = "flag --" + s.Flag
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, nil, err
+	}
+
+	cfg.ApplyDefaults()
+	for _, s := range settings {
+		if origins[s.Key] == "" && s.isSet(cfg) {
+			origins[s.Key] = "default"
+		}
+	}
+	return cfg, origins, nil
+}
+
+// decodeConfig decodes the YAML config b into cfg, rejecting unknown keys, and returns
+// the keys of the settings it sets.
+func decodeConfig(b []byte, cfg *Config, settings []Setting) ([]string, error) {
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil {
+		if err == io.EOF {
+			return nil, nil // empty file
+		}
+		return nil, err
+	}
+	var doc yaml.Node
+	yaml.Unmarshal(b, &doc)
+	// Sections such as backend hold several settings
+	sections := make(map[string]bool)
+	for _, s := range settings {
+		if i := strings.LastIndex(s.Key, "."); i >= 0 {
+			sections[s.Key[:i]] = true
+		}
+	}
+	var keys []string
+	var walk func(n *yaml.Node, prefix string)
+	walk = func(n *yaml.Node, prefix string) {
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key, value := prefix+n.Content[i].Value, n.Content[i+1]
+			if sections[key] && value.Kind == yaml.MappingNode {
+				walk(value, key+".")
+				continue
+			}
+			keys = append(keys, key)
+		}
+	}
+	if len(doc.Content) > 0 && doc.Content[0].Kind == yaml.MappingNode {
+		walk(doc.Content[0], "")
+	}
+	return keys, nil
+}
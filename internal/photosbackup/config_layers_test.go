@@ -0,0 +1,89 @@
+package photosbackup
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolveConfigLayers(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "backup.yaml")
+	os.WriteFile(path, []byte(`
+s3_bucket: from-file
+region: eu-west-1
+storage_class: GLACIER
+backend:
+  type: s3
+sources:
+  - {name: library, path: /photos}
+`), 0644)
+
+	cfg, origins, err := ResolveConfig(ConfigLayers{
+		Env: []string{
+			ConfigEnv + "=" + path,
+			"PHOTOS_BACKUP_REGION=us-east-1",
+			"PHOTOS_BACKUP_STORAGE_CLASS=DEEP_ARCHIVE",
+			"PHOTOS_BACKUP_ALLOWED_EXTENSIONS=[.jpg, .heic]",
+			"PHOTOS_BACKUP_S3_KEY_FORMAT=photos/{year}/{zip}",
+			"HOME=/root",
+		},
+		Flags: map[string]string{"storage_class": "GLACIER_IR", "sniff_content": "true", "backend.path": "/mnt"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.S3Bucket != "from-file" || cfg.Region != "us-east-1" || cfg.StorageClass != "GLACIER_IR" || !cfg.SniffContent ||
+		cfg.S3KeyFormat != "photos/{year}/{zip}" || len(cfg.AllowedExtensions) != 2 || cfg.Backend.Path != "/mnt" || len(cfg.Sources) != 1 {
+		t.Errorf("config %+v", cfg)
+	}
+	for key, want := range map[string]string{
+		"s3_bucket":              "file " + path,
+		"backend.type":           "file " + path,
+		"sources":                "file " + path,
+		"region":                 "env PHOTOS_BACKUP_REGION",
+		"allowed_extensions":     "env PHOTOS_BACKUP_ALLOWED_EXTENSIONS",
+		"storage_class":          "flag --storage-class",
+		"backend.path":           "flag --backend-path",
+		"max_concurrent_uploads": "default",
+		"time_zone":              "",
+	} {
+		if origins[key] != want {
+			t.Errorf("origin of %s = %q, want %q", key, origins[key], want)
+		}
+	}
+
+	var sources Setting
+	for _, s := range Settings() {
+		if s.Key == "sources" {
+			sources = s
+		}
+	}
+	if got := sources.Format(cfg); got != "[{name: library, path: /photos}]" {
+		t.Errorf("sources formatted as %s", got)
+	}
+}
+
+func TestResolveConfigErrors(t *testing.T) {
+	// Without a file given, config.yaml is optional
+	wd, _ := os.Getwd()
+	os.Chdir(t.TempDir())
+	defer os.Chdir(wd)
+	if _, _, err := ResolveConfig(ConfigLayers{Env: []string{"PHOTOS_BACKUP_S3_BUCKET=photos"}}); err != nil {
+		t.Errorf("without config file: %v", err)
+	}
+	if _, _, err := ResolveConfig(ConfigLayers{File: "missing.yaml"}); err == nil {
+		t.Error("missing config file given with --config accepted")
+	}
+
+	_, _, err := ResolveConfig(ConfigLayers{
+		Env:   []string{"PHOTOS_BACKUP_S3_BUKET=photos", "PHOTOS_BACKUP_SCAN_WORKERS=many"},
+		Flags: map[string]string{"rules": "[{action: exclude, glb: x}]"},
+	})
+	for _, want := range []string{"PHOTOS_BACKUP_S3_BUKET is not a setting", "PHOTOS_BACKUP_SCAN_WORKERS", "--rules", "glb"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("error %v lacks %q", err, want)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package photosbackup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigRejectsUnknownKeys(t *testing.T) {
+	// The sample has to stay loadable
+	if _, err := LoadConfig("../../config.sample.yaml"); err != nil {
+		t.Errorf("config.sample.yaml: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	os.WriteFile(path, []byte("s3_bukcet: photos\nrules:\n  - {action: exclude, glb: \"*.tmp\"}\n"), 0644)
+	_, err := LoadConfig(path)
+	if err == nil || !strings.Contains(err.Error(), "s3_bukcet") || !strings.Contains(err.Error(), "glb") {
+		t.Errorf("LoadConfig() error %v, want both unknown keys", err)
+	}
+
+	os.WriteFile(path, nil, 0644)
+	if _, err := LoadConfig(path); err != nil {
+		t.Errorf("empty config: %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	lib := t.TempDir()
+	cfg := &Config{S3Bucket: "photos", PhotosLibrary: lib, StorageClass: "deep_archive"}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate() = %v", err)
+	}
+	if cfg.StorageClass != "DEEP_ARCHIVE" || cfg.MaxConcurrentUploads != 8 || cfg.UploadPartSizeMB != 5 || cfg.S3KeyFormat != "{year}/{zip}" || cfg.CatalogFile != "catalog.db" {
+		t.Errorf("defaults not applied: %+v", cfg)
+	}
+	if cfg := (&Config{S3Bucket: "photos", PhotosLibrary: lib}); cfg.Validate() != nil || cfg.StorageClass != "STANDARD" {
+		t.Errorf("storage class %q, want STANDARD", cfg.StorageClass)
+	}
+
+	// Every problem is reported at once
+	cfg = &Config{
+		PhotosLibrary:        filepath.Join(lib, "missing"),
+		StorageClass:         "GLACER",
+		MaxConcurrentUploads: -1,
+		UploadPartSizeMB:     2,
+		LogLevel:             "loud",
+		TimeZone:             "Mars/Olympus",
+		Rules:                []Rule{{Action: "keep"}},
+		S3KeyFormat:          "{hostname}/{mnth}/{zip}",
+	}
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("Validate() = nil")
+	}
+	for _, want := range []string{
+		"s3_bucket is required",
+		`storage_class: unknown class "GLACER", want one of STANDARD`,
+		"max_concurrent_uploads: -1",
+		"upload_part_size_mb: 2",
+		"log_level",
+		"time_zone",
+		"rules[0]",
+		"s3_key_format: unknown placeholder {mnth}",
+		"photos_library_path: " + filepath.Join(lib, "missing") + " does not exist",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error lacks %q:\n%v", want, err)
+		}
+	}
+	if n := strings.Count(err.Error(), "\n") + 1; n != 9 {
+		t.Errorf("%d problems reported, want 9:\n%v", n, err)
+	}
+
+	// Sources are checked one by one; restores do not need their directories
+	cfg = &Config{
+		Backend:     BackendConfig{Type: "local"},
+		Sources:     []Source{{Name: "library", Path: lib}, {Name: "camera", Path: filepath.Join(lib, "missing"), KeyPrefix: "camera"}, {Name: "a|b", Path: lib, KeyPrefix: "ab"}},
+		S3KeyFormat: "{source}/{year}/{zip}",
+	}
+	err = cfg.Validate()
+	for _, want := range []string{"backend.path is required", "sources[1]: path: ", "sources[2]: s3_key_format: key \"a|b/2024/"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Validate() = %v, want %q", err, want)
+		}
+	}
+
+	// Key prefixes must form usable keys; outer slashes are dropped
+	prefixes := []string{"/camera/", "cam//raw", "../up", "cam#1", "cam\x01"}
+	cfg.Sources = nil
+	for i, p := range prefixes {
+		cfg.Sources = append(cfg.Sources, Source{Name: fmt.Sprint("s", i), Path: lib, KeyPrefix: p})
+	}
+	err = cfg.validate(false)
+	for i := range prefixes {
+		want := fmt.Sprintf("sources[%d]: key_prefix", i)
+		if got := err != nil && strings.Contains(err.Error(), want); got != (i > 0) {
+			t.Errorf("key_prefix %q reported: %v, error %v", prefixes[i], got, err)
+		}
+	}
+
+	cfg.Sources = []Source{{Name: "library", Path: lib}, {Name: "camera", Path: filepath.Join(lib, "missing"), KeyPrefix: "camera"}}
+	cfg.Backend.Path = t.TempDir()
+	if err := cfg.validate(false); err != nil {
+		t.Errorf("validate without paths: %v", err)
+	}
+}
@@ -0,0 +1,114 @@
+package photosbackup
+
+import (
+	"bytes"
+	"math"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+	"github.com/rwcarlsen/goexif/tiff"
+)
+
+// EXIF 2.31 offset tags, which goexif does not know and would otherwise drop.
+const (
+	OffsetTime          exif.FieldName = "OffsetTime"
+	OffsetTimeOriginal  exif.FieldName = "OffsetTimeOriginal"
+	OffsetTimeDigitized exif.FieldName = "OffsetTimeDigitized"
+)
+
+var offsetTimeFields = map[uint16]exif.FieldName{
+	0x9010: OffsetTime,
+	0x9011: OffsetTimeOriginal,
+	0x9012: OffsetTimeDigitized,
+}
+
+func init() {
+	exif.RegisterParsers(offsetTimeParser{})
+}
+
+// offsetTimeParser loads the offset tags from the Exif sub-IFD.
+type offsetTimeParser struct{}
+
+func (offsetTimeParser) Parse(x *exif.Exif) error {
+	ptr, err := x.Get(exif.ExifIFDPointer)
+	if err != nil {
+		return nil
+	}
+	offset, err := ptr.Int64(0)
+	if err != nil || offset < 0 || offset >= int64(len(x.Raw)) {
+		return nil
+	}
+	r := bytes.NewReader(x.Raw)
+	if _, err := r.Seek(offset, 0); err != nil {
+		return nil
+	}
+	dir, _, err := tiff.DecodeDir(r, x.Tiff.Order)
+	if err != nil {
+		return nil // a broken sub-IFD must not stop the other fields from decoding
+	}
+	x.LoadTags(dir, offsetTimeFields, false)
+	return nil
+}
+
+// readExif copies the capture date, camera, exposure, image and GPS info from x into
+// meta. Capture times without a recorded or GPS-derived UTC offset are placed in zone.
+func readExif(x *exif.Exif, meta *PhotoMeta, zone *time.Location) {
+	if t, tz, ok := exifTaken(x, zone); ok {
+		meta.Taken, meta.TimeZone = t, tz
+	}
+	meta.Make = exifString(x, exif.Make)
+	meta.Camera = exifString(x, exif.Model)
+	meta.Lens = exifString(x, exif.LensModel)
+	meta.FocalLength = exifRat(x, exif.FocalLength)
+	meta.ISO = exifInt(x, exif.ISOSpeedRatings)
+	meta.ExposureTime = exifRat(x, exif.ExposureTime)
+	meta.FNumber = exifRat(x, exif.FNumber)
+	meta.Orientation = exifInt(x, exif.Orientation)
+	if meta.Width = exifInt(x, exif.PixelXDimension); meta.Width == 0 {
+		meta.Width = exifInt(x, exif.ImageWidth)
+	}
+	if meta.Height = exifInt(x, exif.PixelYDimension); meta.Height == 0 {
+		meta.Height = exifInt(x, exif.ImageLength)
+	}
+	meta.ContentID = appleContentIdentifier(x)
+	if lat, long, err := x.LatLong(); err == nil {
+		meta.Latitude = lat
+		meta.Longitude = long
+	}
+	if alt := exifRat(x, exif.GPSAltitude); alt != 0 {
+		if exifInt(x, exif.GPSAltitudeRef) == 1 { // below sea level
+			alt = -alt
+		}
+		meta.Altitude = alt
+	}
+}
+
+func exifString(x *exif.Exif, name exif.FieldName) string {
+	tag, err := x.Get(name)
+	if err != nil {
+		return ""
+	}
+	s, _ := tag.StringVal()
+	return s
+}
+
+func exifInt(x *exif.Exif, name exif.FieldName) int {
+	tag, err := x.Get(name)
+	if err != nil {
+		return 0
+	}
+	v, _ := tag.Int(0)
+	return v
+}
+
+func exifRat(x *exif.Exif, name exif.FieldName) float64 {
+	tag, err := x.Get(name)
+	if err != nil {
+		return 0
+	}
+	num, den, err := tag.Rat2(0)
+	if err != nil || den == 0 {
+		return 0
+	}
+	return math.Round(float64(num)/float64(den)*1e6) / 1e6
+}
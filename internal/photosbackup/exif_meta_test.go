@@ -0,0 +1,55 @@
+package photosbackup
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestGetPhotoMetaReadsExtendedExif(t *testing.T) {
+	meta, err := getPhotoMeta("testdata/rich.jpg", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := PhotoMeta{
+		Path:         "testdata/rich.jpg",
+		TimeZone:     "+09:00",
+		Make:         "FUJIFILM",
+		Camera:       "X-T5",
+		Lens:         "XF23mmF1.4 R LM WR",
+		FocalLength:  23,
+		ISO:          400,
+		ExposureTime: 0.004,
+		FNumber:      2.8,
+		Width:        7728,
+		Height:       5152,
+		Orientation:  6,
+		Altitude:     40.5,
+		Size:         444,
+	}
+	got := meta
+	got.Taken, got.Latitude, got.Longitude = time.Time{}, 0, 0
+	if got != want {
+		t.Errorf("got  %+v\nwant %+v", got, want)
+	}
+	if meta.Latitude < 35.65 || meta.Latitude > 35.66 || meta.Longitude < 139.70 || meta.Longitude > 139.71 {
+		t.Errorf("GPS = (%f, %f)", meta.Latitude, meta.Longitude)
+	}
+	if meta.Taken.Year() != 2022 || meta.Taken.Hour() != 23 {
+		t.Errorf("Taken = %v", meta.Taken)
+	}
+}
+
+func TestScanRecordsSizeAndHash(t *testing.T) {
+	dir := t.TempDir()
+	data, _ := os.ReadFile("testdata/rich.jpg")
+	os.WriteFile(dir+"/rich.jpg", data, 0644)
+	res := scanLibrary(t, dir, ScanOptions{AllowedExtensions: []string{".jpg"}})
+	if len(res.Files) != 1 {
+		t.Fatalf("expected rich.jpg, got %v", res.Files)
+	}
+	sum, _ := FileSHA256(dir + "/rich.jpg")
+	if m := res.Files[0]; m.SHA256 != sum || m.Size != 444 {
+		t.Errorf("Size = %d, SHA256 = %s, want 444, %s", m.Size, m.SHA256, sum)
+	}
+}
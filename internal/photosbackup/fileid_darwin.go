@@ -0,0 +1,17 @@
+package photosbackup
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// fileIdentity returns the inode number and status change time of info.
+// The change time cannot be preserved by copies or imports, unlike the mtime.
+func fileIdentity(info os.FileInfo) (inode uint64, ctime time.Time, ok bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, time.Time{}, false
+	}
+	return st.Ino, time.Unix(st.Ctimespec.Unix()), true
+}
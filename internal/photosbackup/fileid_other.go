@@ -0,0 +1,13 @@
+//go:build !linux && !darwin
+
+package photosbackup
+
+import (
+	"os"
+	"time"
+)
+
+// fileIdentity is not available on this platform; callers fall back to size and mtime.
+func fileIdentity(info os.FileInfo) (inode uint64, ctime time.Time, ok bool) {
+	return 0, time.Time{}, false
+}
@@ -0,0 +1,194 @@
+package photosbackup
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// heifExtensions are the HEIF file types whose EXIF is stored as an item in the meta box.
+var heifExtensions = map[string]bool{".heic": true, ".heif": true, ".hif": true, ".avif": true}
+
+// exifSource returns the reader to decode the EXIF of f from: the file itself, or for
+// HEIF files the payload of the Exif item.
+func exifSource(f *os.File, ext string) (io.Reader, error) {
+	if !heifExtensions[ext] {
+		return f, nil
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	payload, err := readHEIFExif(f, info.Size())
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(payload), nil
+}
+
+// readHEIFExif returns the TIFF-formatted EXIF data of the HEIF file r, which is size
+// bytes long. The Exif item is found by type in the iinf box and located through the
+// iloc box; its payload starts with the offset of the TIFF header.
+func readHEIFExif(r io.ReaderAt, size int64) ([]byte, error) {
+	meta, err := readTopLevelBox(r, size, "meta")
+	if err != nil {
+		return nil, err
+	}
+	if len(meta) < 4 {
+		return nil, errors.New("no meta box")
+	}
+	meta = meta[4:] // version and flags
+	id, ok := heifExifItem(findBox(meta, "iinf"))
+	if !ok {
+		return nil, errors.New("no Exif item")
+	}
+	loc, err := heifItemLocation(findBox(meta, "iloc"), id)
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	for _, e := range loc.extents {
+		if e.length > maxBoxRead || uint64(len(data))+e.length > maxBoxRead {
+			return nil, fmt.Errorf("Exif item too large")
+		}
+		chunk := make([]byte, e.length)
+		switch loc.method {
+		case 0: // file offset
+			if _, err := r.ReadAt(chunk, int64(loc.base+e.offset)); err != nil && err != io.EOF {
+				return nil, err
+			}
+		case 1: // offset into the idat box
+			idat := findBox(meta, "idat")
+			start := loc.base + e.offset
+			if start+e.length > uint64(len(idat)) {
+				return nil, errors.New("Exif item outside idat box")
+			}
+			copy(chunk, idat[start:])
+		default:
+			return nil, fmt.Errorf("unsupported iloc construction method %d", loc.method)
+		}
+		data = append(data, chunk...)
+	}
+	if len(data) < 4 {
+		return nil, errors.New("Exif item too short")
+	}
+	start := 4 + uint64(binary.BigEndian.Uint32(data[0:4]))
+	if start >= uint64(len(data)) {
+		return nil, errors.New("Exif item has an invalid TIFF header offset")
+	}
+	return data[start:], nil
+}
+
+// heifExifItem returns the ID of the first item of type "Exif" in an iinf box.
+func heifExifItem(iinf []byte) (uint32, bool) {
+	if len(iinf) < 6 {
+		return 0, false
+	}
+	entries := iinf[6:] // version, flags and a 16-bit entry count
+	if iinf[0] != 0 {
+		if len(iinf) < 8 {
+			return 0, false
+		}
+		entries = iinf[8:] // 32-bit entry count
+	}
+	var id uint32
+	var found bool
+	walkBoxes(entries, func(typ string, infe []byte) bool {
+		if typ != "infe" || len(infe) < 4 {
+			return true
+		}
+		var itemType []byte
+		switch version := infe[0]; {
+		case version == 2 && len(infe) >= 12:
+			id, itemType = uint32(binary.BigEndian.Uint16(infe[4:6])), infe[8:12]
+		case version == 3 && len(infe) >= 14:
+			id, itemType = binary.BigEndian.Uint32(infe[4:8]), infe[10:14]
+		default:
+			return true // versions 0 and 1 carry no item type
+		}
+		found = string(itemType) == "Exif"
+		return !found
+	})
+	return id, found
+}
+
+// heifLocation is where an item's data is stored, as listed in an iloc box.
+type heifLocation struct {
+	method  uint16 // construction method: 0 file offset, 1 idat offset
+	base    uint64
+	extents []heifExtent
+}
+
+type heifExtent struct {
+	offset, length uint64
+}
+
+// heifItemLocation finds item id in an iloc box.
+func heifItemLocation(iloc []byte, id uint32) (heifLocation, error) {
+	var loc heifLocation
+	errShort := errors.New("truncated iloc box")
+	if len(iloc) < 6 {
+		return loc, errShort
+	}
+	version := iloc[0]
+	offsetSize, lengthSize := int(iloc[4]>>4), int(iloc[4]&0xf)
+	baseSize, indexSize := int(iloc[5]>>4), int(iloc[5]&0xf)
+	if version == 0 {
+		indexSize = 0
+	}
+	p := iloc[6:]
+	next := func(n int) (uint64, bool) {
+		if n > len(p) {
+			return 0, false
+		}
+		var v uint64
+		for _, b := range p[:n] {
+			v = v<<8 | uint64(b)
+		}
+		p = p[n:]
+		return v, true
+	}
+	idSize := 2
+	if version == 2 {
+		idSize = 4
+	}
+	count, ok := next(idSize)
+	if !ok {
+		return loc, errShort
+	}
+	for i := uint64(0); i < count; i++ {
+		itemID, ok := next(idSize)
+		if !ok {
+			return loc, errShort
+		}
+		var method uint64
+		if version == 1 || version == 2 {
+			if method, ok = next(2); !ok {
+				return loc, errShort
+			}
+		}
+		_, ok1 := next(2) // data reference index
+		base, ok2 := next(baseSize)
+		extents, ok3 := next(2)
+		if !ok1 || !ok2 || !ok3 {
+			return loc, errShort
+		}
+		l := heifLocation{method: uint16(method & 0xf), base: base}
+		for j := uint64(0); j < extents; j++ {
+			_, ok1 := next(indexSize)
+			offset, ok2 := next(offsetSize)
+			length, ok3 := next(lengthSize)
+			if !ok1 || !ok2 || !ok3 {
+				return loc, errShort
+			}
+			l.extents = append(l.extents, heifExtent{offset, length})
+		}
+		if uint32(itemID) == id {
+			return l, nil
+		}
+	}
+	return loc, fmt.Errorf("item %d not in iloc box", id)
+}
@@ -0,0 +1,51 @@
+package photosbackup
+
+import (
+	"math"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestGetPhotoMetaReadsHEIFExif(t *testing.T) {
+	tests := []struct {
+		file        string
+		make, model string
+		taken       time.Time
+		lat, long   float64
+	}{
+		// iloc version 0, Exif item in mdat with an "Exif\0\0" prefix before the TIFF header
+		{"testdata/iphone.heic", "Apple", "iPhone 13 mini", time.Date(2023, 8, 19, 21, 45, 10, 0, time.Local), 48.8583, 2.2945},
+		// iloc version 1 with the Exif item in idat, infe version 3
+		{"testdata/idat.heic", "samsung", "SM-S911B", time.Date(2021, 2, 3, 4, 5, 6, 0, time.Local), -33.8568, 151.2100},
+	}
+	for _, tt := range tests {
+		meta, err := getPhotoMeta(tt.file, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.file, err)
+		}
+		if meta.Make != tt.make || meta.Camera != tt.model {
+			t.Errorf("%s: camera = %q %q, want %q %q", tt.file, meta.Make, meta.Camera, tt.make, tt.model)
+		}
+		if !meta.Taken.Equal(tt.taken) {
+			t.Errorf("%s: Taken = %v, want %v", tt.file, meta.Taken, tt.taken)
+		}
+		if math.Abs(meta.Latitude-tt.lat) > 1e-4 || math.Abs(meta.Longitude-tt.long) > 1e-4 {
+			t.Errorf("%s: GPS = (%f, %f), want (%f, %f)", tt.file, meta.Latitude, meta.Longitude, tt.lat, tt.long)
+		}
+	}
+}
+
+func TestGetPhotoMetaHEIFWithoutExifUsesModTime(t *testing.T) {
+	info, err := os.Stat("testdata/no_exif.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := getPhotoMeta("testdata/no_exif.heic", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Camera != "" || !meta.Taken.Equal(info.ModTime()) {
+		t.Errorf("unexpected metadata %+v", meta)
+	}
+}
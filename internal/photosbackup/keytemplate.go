@@ -0,0 +1,282 @@
+package photosbackup
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// s3_key_format is a template of the key of each archive. Placeholders in braces are
+// replaced with values of the archive, the source and the run:
+//
+//	{year}           year of the archive's month, e.g. 2024
+//	{month}          month, e.g. 06
+//	{ym}             year and month, e.g. 2024-06
+//	{date:LAYOUT}    the month formatted with a Go time layout, e.g. {date:2006/01-Jan}
+//	{zip}            archive name, e.g. 2024-06_20240701T153000.zip; the format ends with it
+//	{source}         name of the source (requires sources)
+//	{hostname}       name of this machine (hostname in the config, or the host name up to the first dot)
+//	{camera}         camera that took most of the archive's files, e.g. Apple-iPhone-15-Pro
+//	{storage_class}  storage_class, e.g. DEEP_ARCHIVE
+//	{run_id}         time the run started, e.g. 20240701T153000, shared by its archives
+
+// keyPlaceholders are the placeholders of s3_key_format, apart from {date:LAYOUT}.
+var keyPlaceholders = []string{"year", "month", "ym", "zip", "source", "hostname", "camera", "storage_class", "run_id"}
+
+// keyPart is literal text or a placeholder of a key template.
+type keyPart struct {
+	literal string
+	field   string // Placeholder name; "" for literal text
+	layout  string // Time layout of {date:LAYOUT}
+}
+
+// keyTemplate is a parsed s3_key_format.
+type keyTemplate []keyPart
+
+// parseKeyTemplate parses an s3_key_format.
+func parseKeyTemplate(format string) (keyTemplate, error) {
+	var t keyTemplate
+	rest := format
+	zips := 0
+	for rest != "" {
+		open := strings.IndexAny(rest, "{}")
+		if open < 0 {
+			t = append(t, keyPart{literal: rest})
+			break
+		}
+		if rest[open] == '}' {
+			return nil, fmt.Errorf("unmatched } in %q", format)
+		}
+		if open > 0 {
+			t = append(t, keyPart{literal: rest[:open]})
+		}
+		end := strings.IndexByte(rest[open:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("unclosed { in %q", format)
+		}
+		name := rest[open+1 : open+end]
+		rest = rest[open+end+1:]
+
+		if layout, ok := strings.CutPrefix(name, "date:"); ok {
+			if layout == "" {
+				return nil, errors.New("{date:} needs a time layout, e.g. {date:2006/01}")
+			}
+			t = append(t, keyPart{field: "date", layout: layout})
+			continue
+		}
+		if !slices.Contains(keyPlaceholders, name) {
+			return nil, fmt.Errorf("unknown placeholder {%s}; known are {%s} and {date:LAYOUT}", name, strings.Join(keyPlaceholders, "}, {"))
+		}
+		if name == "zip" {
+			zips++
+		}
+		t = append(t, keyPart{field: name})
+	}
+	// Archives are recognized by their name, the last part of the key
+	if zips != 1 || t[len(t)-1].field != "zip" {
+		return nil, fmt.Errorf("%q must end with {zip} and contain it once", format)
+	}
+	return t, nil
+}
+
+// uses reports whether the template contains the placeholder.
+func (t keyTemplate) uses(field string) bool {
+	for _, p := range t {
+		if p.field == field {
+			return true
+		}
+	}
+	return false
+}
+
+// KeyValues are the values the placeholders of a key template are replaced with.
+type KeyValues struct {
+	Zip          string // Archive name; the month and run ID are taken from it
+	Source       string
+	Hostname     string
+	Camera       string
+	StorageClass string
+}
+
+// archiveNameParts matches archive names and captures the year, the month and the run ID.
+var archiveNameParts = regexp.MustCompile(`^(\d{4})-(\d{2})_(\d{8}T\d{6})\.zip$`)
+
+// render returns the key for v. It fails if v.Zip is not an archive name or the key
+// contains characters S3 keys should not.
+func (t keyTemplate) render(v KeyValues) (string, error) {
+	key, err := t.expand(v, func(field, value string) string { return value })
+	if err != nil {
+		return "", err
+	}
+	return key, checkKey(key)
+}
+
+// match returns a pattern that matches the keys of archive v.Zip written with any
+// camera and storage class.
+func (t keyTemplate) match(v KeyValues) (*regexp.Regexp, error) {
+	pattern, err := t.expand(v, func(field, value string) string {
+		if field == "camera" || field == "storage_class" {
+			return `[^/]+`
+		}
+		return regexp.QuoteMeta(value)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return regexp.Compile("^" + pattern + "$")
+}
+
+// expand replaces the placeholders of t with the values of v, passed through value, and
+// quotes literal text with value("", text).
+func (t keyTemplate) expand(v KeyValues, value func(field, value string) string) (string, error) {
+	m := archiveNameParts.FindStringSubmatch(v.Zip)
+	if m == nil {
+		return "", fmt.Errorf("%q is not an archive name", v.Zip)
+	}
+	month, err := time.Parse("2006-01", m[1]+"-"+m[2])
+	if err != nil {
+		return "", fmt.Errorf("%q is not an archive name", v.Zip)
+	}
+	var b strings.Builder
+	for _, p := range t {
+		var s string
+		switch p.field {
+		case "":
+			s = p.literal
+		case "year":
+			s = m[1]
+		case "month":
+			s = m[2]
+		case "ym":
+			s = m[1] + "-" + m[2]
+		case "date":
+			s = month.Format(p.layout)
+		case "zip":
+			s = v.Zip
+		case "source":
+			if v.Source == "" {
+				return "", errors.New("{source} needs named sources; photos_library_path has no name")
+			}
+			s = v.Source
+		case "hostname":
+			s = keySafe(v.Hostname)
+		case "camera":
+			s = keySafe(v.Camera)
+		case "storage_class":
+			s = keySafe(v.StorageClass)
+		case "run_id":
+			s = m[3]
+		}
+		b.WriteString(value(p.field, s))
+	}
+	return b.String(), nil
+}
+
+// prefix returns the literal start of the keys of v, up to the first placeholder that
+// depends on the archive. Listing it finds every archive of the source.
+func (t keyTemplate) prefix(v KeyValues) string {
+	var b strings.Builder
+	for _, p := range t {
+		switch p.field {
+		case "":
+			b.WriteString(p.literal)
+		case "source":
+			b.WriteString(v.Source)
+		case "hostname":
+			b.WriteString(keySafe(v.Hostname))
+		default:
+			return b.String()
+		}
+	}
+	return b.String()
+}
+
+// keyUnsafe are the characters AWS recommends to avoid in keys. Some break URLs, others
+// are handled inconsistently by tools.
+const keyUnsafe = "\\{}^%`[]\"<>~#|"
+
+// checkKey returns an error if key is not a usable S3 key: empty, longer than 1024 bytes,
+// with control or unsafe characters, or with empty, "." or ".." path segments.
+func checkKey(key string) error {
+	if key == "" || len(key) > 1024 {
+		return fmt.Errorf("key %q must have 1 to 1024 bytes", key)
+	}
+	for _, r := range key {
+		if r < 0x20 || r == 0x7f || strings.ContainsRune(keyUnsafe, r) || r == unicode.ReplacementChar {
+			return fmt.Errorf("key %q contains %q, which is not allowed in S3 keys", key, r)
+		}
+	}
+	for _, seg := range strings.Split(key, "/") {
+		if seg == "" || seg == "." || seg == ".." {
+			return fmt.Errorf("key %q has an empty, \".\" or \"..\" folder", key)
+		}
+	}
+	return nil
+}
+
+// keySafe turns a value such as a camera model into one folder name: characters that are
+// unsafe in keys, slashes and spaces become dashes. Empty values become "unknown".
+func keySafe(s string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.TrimSpace(s) {
+		if r < 0x20 || r == 0x7f || unicode.IsSpace(r) || r == '/' || strings.ContainsRune(keyUnsafe, r) || r == unicode.ReplacementChar {
+			dash = true
+			continue
+		}
+		if dash && b.Len() > 0 {
+			b.WriteByte('-')
+		}
+		dash = false
+		b.WriteRune(r)
+	}
+	if s := strings.Trim(b.String(), "."); s != "" {
+		return s
+	}
+	return "unknown"
+}
+
+// archiveCamera returns the camera that took most of files, as make and model, or "" if
+// none records one. Ties go to the name that sorts first.
+func archiveCamera(files []PhotoMeta) string {
+	counts := make(map[string]int)
+	for _, f := range files {
+		name := strings.TrimSpace(f.Camera)
+		// Models often start with the make, e.g. "Canon EOS R5"
+		if mk := strings.TrimSpace(f.Make); mk != "" && !strings.HasPrefix(strings.ToLower(name), strings.ToLower(mk)) {
+			name = strings.TrimSpace(mk + " " + name)
+		}
+		if name != "" {
+			counts[name]++
+		}
+	}
+	var names []string
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	best := ""
+	for _, name := range names {
+		if best == "" || counts[name] > counts[best] {
+			best = name
+		}
+	}
+	return best
+}
+
+// defaultHostname returns the host name up to the first dot, e.g. "studio" for
+// "studio.local", or "" if it is not known.
+func defaultHostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return ""
+	}
+	name, _, _ = strings.Cut(name, ".")
+	return name
+}
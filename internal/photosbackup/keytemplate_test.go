@@ -0,0 +1,124 @@
+package photosbackup
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestKeyTemplate(t *testing.T) {
+	v := KeyValues{Zip: "2024-06_20240701T153000.zip", Source: "library", Hostname: "studio", Camera: "Apple iPhone 15 Pro", StorageClass: "DEEP_ARCHIVE"}
+	for _, tt := range []struct{ format, want string }{
+		{"{year}/{zip}", "2024/2024-06_20240701T153000.zip"},
+		{"{hostname}/{year}/{month}/{zip}", "studio/2024/06/2024-06_20240701T153000.zip"},
+		{"photos/{source}/{ym}/{camera}/{zip}", "photos/library/2024-06/Apple-iPhone-15-Pro/2024-06_20240701T153000.zip"},
+		{"{storage_class}/{run_id}/{zip}", "DEEP_ARCHIVE/20240701T153000/2024-06_20240701T153000.zip"},
+		{"{date:2006/01-Jan}/{zip}", "2024/06-Jun/2024-06_20240701T153000.zip"},
+	} {
+		tmpl, err := parseKeyTemplate(tt.format)
+		if err != nil {
+			t.Errorf("%s: %v", tt.format, err)
+			continue
+		}
+		if key, err := tmpl.render(v); key != tt.want || err != nil {
+			t.Errorf("%s: render() = %q, %v, want %q", tt.format, key, err, tt.want)
+		}
+	}
+
+	for _, tt := range []struct{ format, want string }{
+		{"{year}/{camra}/{zip}", "unknown placeholder {camra}"},
+		{"{year/{zip}", "unknown placeholder {year/{zip}"},
+		{"{year}/{zip", "unclosed {"},
+		{"{year}}/{zip}", "unmatched }"},
+		{"{zip}/{year}", "must end with {zip}"},
+		{"{year}/photos", "must end with {zip}"},
+		{"{date:}/{zip}", "needs a time layout"},
+	} {
+		if _, err := parseKeyTemplate(tt.format); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: error %v, want %q", tt.format, err, tt.want)
+		}
+	}
+
+	tmpl, _ := parseKeyTemplate("{source}/{zip}")
+	if _, err := tmpl.render(KeyValues{Zip: v.Zip}); err == nil {
+		t.Error("{source} rendered for an unnamed source")
+	}
+	tmpl, _ = parseKeyTemplate("backup#1/{zip}")
+	if _, err := tmpl.render(v); err == nil || !strings.Contains(err.Error(), `'#'`) {
+		t.Errorf("key with # accepted: %v", err)
+	}
+}
+
+func TestCheckKeyAndKeySafe(t *testing.T) {
+	for key, ok := range map[string]bool{
+		"2024/06/a.zip":           true,
+		"fotos/été/a.zip":         true,
+		"a//b.zip":                false,
+		"/a.zip":                  false,
+		"../a.zip":                false,
+		"a\x01.zip":               false,
+		"a{b}.zip":                false,
+		strings.Repeat("a", 1025): false,
+	} {
+		if err := checkKey(key); (err == nil) != ok {
+			t.Errorf("checkKey(%q) = %v", key, err)
+		}
+	}
+	for in, want := range map[string]string{
+		"Canon EOS 5D Mark IV": "Canon-EOS-5D-Mark-IV",
+		" NIKON  D850/2 ":      "NIKON-D850-2",
+		"..":                   "unknown",
+		"":                     "unknown",
+	} {
+		if got := keySafe(in); got != want {
+			t.Errorf("keySafe(%q) = %q, want %q", in, got, want)
+		}
+	}
+	files := []PhotoMeta{
+		{Make: "Canon", Camera: "Canon EOS R5"}, {Make: "Apple", Camera: "iPhone 15"},
+		{Make: "Apple", Camera: "iPhone 15"}, {Path: "a.xmp"},
+	}
+	if got := archiveCamera(files); got != "Apple iPhone 15" {
+		t.Errorf("archiveCamera() = %q", got)
+	}
+	if got := archiveCamera(files[:2]); got != "Apple iPhone 15" {
+		t.Errorf("archiveCamera() of a tie = %q, want the first name", got)
+	}
+}
+
+func TestTemplatedKeysEndToEnd(t *testing.T) {
+	ctx := context.Background()
+	r, cfg := newTestRunner(t, RunOptions{})
+	cfg.S3KeyFormat = "{hostname}/{year}/{month}/{camera}/{zip}"
+	cfg.Hostname = "studio"
+	r.Close()
+	r, err := NewRunner(ctx, cfg, RunOptions{Dir: r.opts.Dir, Out: r.opts.Out})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	res, err := r.Backup(ctx)
+	if err != nil || len(res.Sources[0].Archives) != 2 {
+		t.Fatalf("Backup: %+v, %v", res, err)
+	}
+	for _, a := range res.Sources[0].Archives {
+		if !strings.HasPrefix(a.Key, "studio/"+a.Month[:4]+"/"+a.Month[5:]+"/") || r.State().CompletedMonths[a.Month] != a.Key {
+			t.Errorf("key %s of %s, state %q", a.Key, a.Month, r.State().CompletedMonths[a.Month])
+		}
+	}
+
+	// Another machine's archive in the same bucket is not this source's
+	other := "laptop/2021/01/Apple-iPhone/2021-01_20210201T120000.zip"
+	r.Backend().Put(ctx, other, strings.NewReader("zip"), PutOptions{})
+	src := r.Sources()[0]
+	archives, err := SourceArchives(ctx, r.Backend(), cfg, src, "", "")
+	if err != nil || len(archives) != 2 {
+		t.Errorf("SourceArchives() = %v, %v", archives, err)
+	}
+	if src.listPrefix(cfg) != "studio/" || src.ownsArchive(cfg, other) || !src.ownsArchive(cfg, "studio/2021/01/Nikon/2021-01_20210201T120000.zip") {
+		t.Errorf("ownership of %s", other)
+	}
+	if res, err := r.Prune(ctx, "", true); err != nil || res.Archives != 0 {
+		t.Errorf("Prune() = %+v, %v", res, err)
+	}
+}
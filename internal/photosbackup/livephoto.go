@@ -0,0 +1,171 @@
+package photosbackup
+
+import (
+	"bytes"
+	"encoding/binary"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// A Live Photo is a still (HEIC or JPEG) and a short video (MOV). The camera writes the
+// same content identifier into both: tag 0x11 of the Apple maker note in the still and
+// the com.apple.quicktime.content.identifier key in the video. The Photos library also
+// stores them side by side as <UUID>.heic and <UUID>_3.mov.
+
+// appleContentIDTag is the maker note tag holding the Live Photo content identifier.
+const appleContentIDTag = 0x11
+
+// appleContentIdentifier returns the Live Photo content identifier recorded in the
+// Apple maker note of x, or "" if there is none.
+func appleContentIdentifier(x *exif.Exif) string {
+	tag, err := x.Get(exif.MakerNote)
+	if err != nil {
+		return ""
+	}
+	return parseAppleMakerNote(tag.Val)
+}
+
+// parseAppleMakerNote reads the content identifier from an Apple maker note: the
+// signature "Apple iOS\0", a version, a byte order mark and an IFD whose offsets are
+// relative to the start of the maker note.
+func parseAppleMakerNote(p []byte) string {
+	if len(p) < 16 || !bytes.HasPrefix(p, []byte("Apple iOS\x00")) {
+		return ""
+	}
+	var order binary.ByteOrder = binary.BigEndian
+	if string(p[12:14]) == "II" {
+		order = binary.LittleEndian
+	}
+	n := int(order.Uint16(p[14:16]))
+	for i := 0; i < n; i++ {
+		off := 16 + 12*i
+		if off+12 > len(p) {
+			break
+		}
+		e := p[off : off+12]
+		if order.Uint16(e[0:2]) != appleContentIDTag || order.Uint16(e[2:4]) != 2 { // ASCII
+			continue
+		}
+		count := int(order.Uint32(e[4:8]))
+		var v []byte
+		if count <= 4 {
+			v = e[8 : 8+count]
+		} else if start := int(order.Uint32(e[8:12])); start+count <= len(p) {
+			v = p[start : start+count]
+		}
+		return strings.TrimRight(string(v), "\x00")
+	}
+	return ""
+}
+
+// uuidStemRe matches the file name stem of a Photos library original, optionally with
+// the "_3" suffix of a Live Photo's video.
+var uuidStemRe = regexp.MustCompile(`^([0-9A-Fa-f]{8}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{12})(_3)?$`)
+
+// livePhotoKey returns the key shared by the components of a Live Photo stored under a
+// UUID name: the directory and the UUID.
+func livePhotoKey(path string) (string, bool) {
+	base := filepath.Base(path)
+	m := uuidStemRe.FindStringSubmatch(strings.TrimSuffix(base, filepath.Ext(base)))
+	if m == nil {
+		return "", false
+	}
+	return filepath.Join(filepath.Dir(path), strings.ToUpper(m[1])), true
+}
+
+// pairLivePhotos returns the index of the still of every Live Photo video in photos,
+// matched by content identifier or, failing that, by UUID name. Videos already paired
+// with a still outside photos are left alone.
+func pairLivePhotos(photos []PhotoMeta) map[int]int {
+	byContentID := make(map[string]int)
+	byKey := make(map[string]int)
+	for i, meta := range photos {
+		if meta.Primary != "" || videoExtensions[strings.ToLower(filepath.Ext(meta.Path))] {
+			continue
+		}
+		if _, ok := byContentID[meta.ContentID]; meta.ContentID != "" && !ok {
+			byContentID[meta.ContentID] = i
+		}
+		if key, ok := livePhotoKey(meta.Path); ok {
+			if _, dup := byKey[key]; !dup {
+				byKey[key] = i
+			}
+		}
+	}
+	stillOf := make(map[int]int)
+	paired := make(map[int]bool) // stills that already have a video
+	for i, meta := range photos {
+		if meta.Primary != "" || meta.LivePhoto != "" || !videoExtensions[strings.ToLower(filepath.Ext(meta.Path))] {
+			continue
+		}
+		still, ok := byContentID[meta.ContentID]
+		if meta.ContentID == "" || !ok {
+			var key string
+			if key, ok = livePhotoKey(meta.Path); ok {
+				still, ok = byKey[key]
+			}
+		}
+		if ok && !paired[still] {
+			stillOf[i] = still
+			paired[still] = true
+		}
+	}
+	return stillOf
+}
+
+// pairWithOldStills pairs each Live Photo video among the new files whose still is not
+// new, such as a still backed up before the video was imported, with that still, so the
+// video is stored in the still's month like the pairs GroupPhotosByYearMonth finds. The
+// still is one of the scanned items, matched by UUID name or, in the same directory under
+// the same name, by content identifier; its date is read through the scan cache.
+func pairWithOldStills(files []PhotoMeta, items []scanItem, opts ScanOptions) {
+	paired := make(map[int]bool)
+	for video := range pairLivePhotos(files) {
+		paired[video] = true
+	}
+	isNew := make(map[string]bool, len(files))
+	for _, f := range files {
+		isNew[f.Path] = true
+	}
+	var videos []int
+	for i, f := range files {
+		if f.Primary == "" && !paired[i] && videoExtensions[strings.ToLower(filepath.Ext(f.Path))] {
+			videos = append(videos, i)
+		}
+	}
+	if len(videos) == 0 {
+		return
+	}
+	byKey := make(map[string]scanItem)
+	byStem := make(map[string]scanItem)
+	for _, item := range items {
+		if item.sidecar || isNew[item.path] || videoExtensions[strings.ToLower(filepath.Ext(item.path))] {
+			continue
+		}
+		if key, ok := livePhotoKey(item.path); ok {
+			byKey[key] = item
+		}
+		byStem[strings.ToLower(strings.TrimSuffix(item.path, filepath.Ext(item.path)))] = item
+	}
+	for _, i := range videos {
+		video := &files[i]
+		still, byName := scanItem{}, false
+		if key, ok := livePhotoKey(video.Path); ok {
+			still, byName = byKey[key]
+		}
+		if !byName {
+			var ok bool
+			if still, ok = byStem[strings.ToLower(strings.TrimSuffix(video.Path, filepath.Ext(video.Path)))]; !ok || video.ContentID == "" {
+				continue
+			}
+		}
+		meta, err := opts.Cache.PhotoMeta(still.path, still.info, opts.DefaultZone)
+		if err != nil || (!byName && meta.ContentID != video.ContentID) {
+			continue
+		}
+		video.LivePhoto, video.stillTaken = still.path, meta.Taken
+	}
+}
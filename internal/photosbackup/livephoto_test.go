@@ -0,0 +1,114 @@
+package photosbackup
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseAppleMakerNote(t *testing.T) {
+	id := "8C1B3E02-5D0F-4F4B-9A4B-2E4A4F3C0C11\x00"
+	note := []byte("Apple iOS\x00\x00\x01MM")
+	note = binary.BigEndian.AppendUint16(note, 2)
+	entry := func(tag, typ uint16, count, value uint32) {
+		note = binary.BigEndian.AppendUint16(note, tag)
+		note = binary.BigEndian.AppendUint16(note, typ)
+		note = binary.BigEndian.AppendUint32(note, count)
+		note = binary.BigEndian.AppendUint32(note, value)
+	}
+	entry(0x01, 9, 1, 14) // maker note version
+	entry(0x11, 2, uint32(len(id)), 16+2*12+4)
+	note = append(binary.BigEndian.AppendUint32(note, 0), id...) // next IFD, then the value
+	if got := parseAppleMakerNote(note); got != "8C1B3E02-5D0F-4F4B-9A4B-2E4A4F3C0C11" {
+		t.Errorf("content identifier = %q", got)
+	}
+	if got := parseAppleMakerNote(note[:30]); got != "" {
+		t.Errorf("truncated maker note gave %q", got)
+	}
+	if got := parseAppleMakerNote([]byte("FUJIFILM\x0c\x00\x00\x00\x00\x00\x00\x00")); got != "" {
+		t.Errorf("other maker note gave %q", got)
+	}
+}
+
+func TestGroupPhotosByYearMonthKeepsLivePhotosTogether(t *testing.T) {
+	dec := time.Date(2022, 12, 31, 23, 59, 58, 0, time.UTC)
+	jan := time.Date(2023, 1, 1, 0, 0, 1, 0, time.UTC)
+	const uuid = "/lib/originals/4/4A2B7C1D-0E3F-4A5B-8C6D-7E8F9A0B1C2D"
+	photos := []PhotoMeta{
+		{Path: "/dcim/IMG_0001.HEIC", Taken: dec, ContentID: "ID-1"},
+		{Path: "/dcim/IMG_0001.MOV", Taken: jan, ContentID: "ID-1"},
+		{Path: uuid + ".heic", Taken: dec},
+		{Path: uuid + "_3.mov", Taken: jan},
+		{Path: uuid + "_3.mov.xmp", Taken: jan, Primary: uuid + "_3.mov"},
+		{Path: "/dcim/IMG_0002.MOV", Taken: jan, ContentID: "ID-2"}, // no still
+	}
+	groups := GroupPhotosByYearMonth(photos, nil)
+	if len(groups["2022-12"]) != 5 || len(groups["2023-01"]) != 1 {
+		t.Fatalf("groups = %v", groups)
+	}
+	want := map[string]string{
+		"/dcim/IMG_0001.HEIC": "/dcim/IMG_0001.MOV",
+		"/dcim/IMG_0001.MOV":  "/dcim/IMG_0001.HEIC",
+		uuid + ".heic":        uuid + "_3.mov",
+		uuid + "_3.mov":       uuid + ".heic",
+	}
+	for _, meta := range groups["2022-12"] {
+		if meta.LivePhoto != want[meta.Path] {
+			t.Errorf("%s: LivePhoto = %q, want %q", meta.Path, meta.LivePhoto, want[meta.Path])
+		}
+		if meta.Path == uuid+"_3.mov" && !meta.Taken.Equal(jan) {
+			t.Errorf("the video's own date was changed to %v", meta.Taken)
+		}
+	}
+	if groups["2023-01"][0].LivePhoto != "" || photos[0].LivePhoto != "" {
+		t.Error("unpaired video or the caller's slice was marked")
+	}
+}
+
+func TestLimitFilesKeepsLivePhotosTogether(t *testing.T) {
+	files := []PhotoMeta{
+		{Path: "/dcim/IMG_0001.HEIC", ContentID: "ID-1"},
+		{Path: "/dcim/IMG_0001.AAE", Primary: "/dcim/IMG_0001.HEIC"},
+		{Path: "/dcim/IMG_0002.JPG"},
+		{Path: "/other/IMG_0001.MOV", ContentID: "ID-1"},
+		{Path: "/other/IMG_0001.MOV.xmp", Primary: "/other/IMG_0001.MOV"},
+		{Path: "/other/IMG_0003.JPG"},
+	}
+	got := limitFiles(files, 1)
+	if len(got) != 4 || got[2].Path != "/other/IMG_0001.MOV" || got[3].Primary != "/other/IMG_0001.MOV" {
+		t.Errorf("limitFiles(1) = %v", got)
+	}
+	if got := limitFiles(files, 3); len(got) != 5 {
+		t.Errorf("limitFiles(3) kept %d files, want 5", len(got))
+	}
+}
+
+func TestFindNewPhotosPairsVideoWithOldStill(t *testing.T) {
+	dir := t.TempDir()
+	const uuid = "4A2B7C1D-0E3F-4A5B-8C6D-7E8F9A0B1C2D"
+	still := filepath.Join(dir, uuid+".jpg")
+	data, _ := os.ReadFile("testdata/rich.jpg") // taken 2022-12-31
+	os.WriteFile(still, data, 0644)
+	info, _ := os.Stat(still)
+	c := openTestCatalog(t)
+	sum, _ := FileSHA256(still)
+	c.Add(&CatalogEntry{SHA256: sum, SourcePath: still, Size: info.Size(), ModTime: info.ModTime(), Key: "2022/2022-12_20230101T000000.zip"})
+
+	// The video is imported later and carries no date of its own
+	video := filepath.Join(dir, uuid+"_3.mov")
+	os.WriteFile(video, []byte("not a real movie"), 0644)
+	os.WriteFile(video+".xmp", []byte("<x:xmpmeta/>"), 0644)
+	res := scanLibrary(t, dir, ScanOptions{AllowedExtensions: []string{".jpg", ".mov"}, Catalog: c})
+	if len(res.Files) != 2 || res.Files[0].LivePhoto != still {
+		t.Fatalf("files %+v", res.Files)
+	}
+	groups := GroupPhotosByYearMonth(res.Files, nil)
+	if len(groups["2022-12"]) != 2 {
+		t.Errorf("groups = %v, want the video and its sidecar in the still's month", groups)
+	}
+	if res.Files[0].Taken.Year() == 2022 {
+		t.Errorf("the video's own date was changed to %v", res.Files[0].Taken)
+	}
+}
@@ -0,0 +1,138 @@
+package photosbackup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LocalBackend stores objects as files below a root directory, e.g. a NAS mount.
+// Keys map to relative paths; storage classes are ignored.
+type LocalBackend struct {
+	Root string
+}
+
+// NewLocalBackend returns a backend rooted at dir, creating it if needed.
+func NewLocalBackend(dir string) (*LocalBackend, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("local backend requires backend.path")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &LocalBackend{Root: dir}, nil
+}
+
+// path maps key to a file below Root, rejecting keys that escape it.
+func (b *LocalBackend) path(key string) (string, error) {
+	p := filepath.Join(b.Root, filepath.FromSlash(key))
+	rel, err := filepath.Rel(b.Root, p)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return "", fmt.Errorf("invalid key %q", key)
+	}
+	return p, nil
+}
+
+// Put writes body to key via a temporary file so readers never see partial objects.
+func (b *LocalBackend) Put(ctx context.Context, key string, body io.Reader, opts PutOptions) error {
+	p, err := b.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+// Get opens the object at key for reading.
+func (b *LocalBackend) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	p, err := b.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+// Head returns the size, modification time and SHA256 checksum of the object at key.
+// The checksum is computed from the file, as a filesystem keeps no stored digest.
+func (b *LocalBackend) Head(ctx context.Context, key string) (ObjectInfo, error) {
+	p, err := b.path(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	cw := newChecksumWriter(0)
+	if _, err := io.Copy(cw, f); err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{
+		Key:            key,
+		Size:           info.Size(),
+		LastModified:   info.ModTime(),
+		ChecksumSHA256: cw.Sum().Full,
+	}, nil
+}
+
+// List returns all objects whose key starts with prefix.
+func (b *LocalBackend) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	err := filepath.WalkDir(b.Root, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".upload-") {
+			return nil
+		}
+		rel, err := filepath.Rel(b.Root, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, ObjectInfo{Key: key, Size: info.Size(), LastModified: info.ModTime()})
+		return nil
+	})
+	return objects, err
+}
+
+// Delete removes the object at key.
+func (b *LocalBackend) Delete(ctx context.Context, key string) error {
+	p, err := b.path(key)
+	if err != nil {
+		return err
+	}
+	return os.Remove(p)
+}
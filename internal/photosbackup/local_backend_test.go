@@ -0,0 +1,63 @@
+package photosbackup
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLocalBackendRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	cfg := &Config{Backend: BackendConfig{Type: "local", Path: t.TempDir()}}
+	b, err := NewBackend(ctx, cfg)
+	if err != nil {
+		t.Fatalf("NewBackend: %v", err)
+	}
+
+	dir := t.TempDir()
+	os.WriteFile(dir+"/a.jpg", []byte("photo"), 0644)
+	zipName := dir + "/2024-01.zip"
+	zf, _ := os.Create(zipName)
+	if _, err := WriteZip(zf, "2024-01.zip", []PhotoMeta{{Path: dir + "/a.jpg"}}, nil); err != nil {
+		t.Fatalf("WriteZip: %v", err)
+	}
+	zf.Close()
+	if err := UploadFile(ctx, b, "2024/2024-01.zip", zipName, "STANDARD"); err != nil {
+		t.Fatalf("UploadFile: %v", err)
+	}
+
+	localSum, _ := FileSHA256(zipName)
+	info, err := b.Head(ctx, "2024/2024-01.zip")
+	raw, _ := base64.StdEncoding.DecodeString(info.ChecksumSHA256)
+	if err != nil || fmt.Sprintf("%x", raw) != localSum {
+		t.Errorf("Head returned %+v, %v; want checksum of %s", info, err, localSum)
+	}
+	if fi, _ := os.Stat(zipName); info.Size != fi.Size() {
+		t.Errorf("Head size %d, want %d", info.Size, fi.Size())
+	}
+	objs, err := b.List(ctx, "2024/")
+	if err != nil || len(objs) != 1 || objs[0].Key != "2024/2024-01.zip" {
+		t.Errorf("List returned %+v, %v", objs, err)
+	}
+
+	if err := b.Delete(ctx, "2024/2024-01.zip"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := b.Get(ctx, "2024/2024-01.zip"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected not-exist after delete, got %v", err)
+	}
+}
+
+func TestLocalBackendRejectsEscapingKeys(t *testing.T) {
+	b, err := NewLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Put(context.Background(), "../outside.zip", strings.NewReader("x"), PutOptions{}); err == nil {
+		t.Error("expected error for key outside root")
+	}
+}
@@ -0,0 +1,74 @@
+package photosbackup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// ManifestName is the archive member that holds the archive's manifest.
+const ManifestName = "manifest.json"
+
+// Manifest lists the original files stored in an archive.
+type Manifest struct {
+	Archive string          `json:"archive"`
+	Created time.Time       `json:"created"`
+	Files   []ManifestEntry `json:"files"`
+}
+
+// ManifestEntry records one original file and the member it was stored as.
+type ManifestEntry struct {
+	Path    string    `json:"path"`
+	Member  string    `json:"member"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	SHA256  string    `json:"sha256"`
+	Meta    PhotoMeta `json:"meta"`
+	// Duplicates are other source paths with identical content, stored only once as Member.
+	Duplicates []string `json:"duplicates,omitempty"`
+}
+
+// ManifestKey returns the key of the sidecar manifest stored next to an archive.
+func ManifestKey(archiveKey string) string {
+	return strings.TrimSuffix(archiveKey, ".zip") + ".manifest.json"
+}
+
+// UploadManifest stores m as the sidecar of the archive at archiveKey. Sidecars use
+// the backend's default storage class so they stay readable when archives are in GLACIER.
+func UploadManifest(ctx context.Context, b Backend, archiveKey string, m *Manifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return b.Put(ctx, ManifestKey(archiveKey), bytes.NewReader(data), PutOptions{})
+}
+
+// FetchManifest reads the sidecar manifest of the archive at archiveKey.
+func FetchManifest(ctx context.Context, b Backend, archiveKey string) (*Manifest, error) {
+	body, err := b.Get(ctx, ManifestKey(archiveKey))
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	var m Manifest
+	if err := json.NewDecoder(body).Decode(&m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// uniqueMember returns name, or name with a " (n)" suffix if it is already used.
+func uniqueMember(name string, used map[string]bool) string {
+	ext := path.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	member := name
+	for n := 2; used[member]; n++ {
+		member = fmt.Sprintf("%s (%d)%s", stem, n, ext)
+	}
+	used[member] = true
+	return member
+}
@@ -0,0 +1,60 @@
+package photosbackup
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"os"
+	"testing"
+)
+
+func TestUploadZipEmbedsManifest(t *testing.T) {
+	ctx := context.Background()
+	b, err := NewLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	os.Mkdir(dir+"/other", 0755)
+	os.WriteFile(dir+"/a.jpg", []byte("photo a"), 0644)
+	os.WriteFile(dir+"/other/a.jpg", []byte("another a"), 0644)
+	files := []PhotoMeta{{Path: dir + "/a.jpg"}, {Path: dir + "/other/a.jpg"}}
+
+	key := "2024/2024-04_20240501T120000.zip"
+	_, manifest, err := UploadZip(ctx, b, key, files, nil, PutOptions{})
+	if err != nil {
+		t.Fatalf("UploadZip: %v", err)
+	}
+	if len(manifest.Files) != 2 || manifest.Files[0].Member != "a.jpg" || manifest.Files[1].Member != "a (2).jpg" {
+		t.Fatalf("unexpected manifest members: %+v", manifest.Files)
+	}
+	if e := manifest.Files[1]; e.Path != dir+"/other/a.jpg" || e.Size != 9 || len(e.SHA256) != 64 {
+		t.Errorf("unexpected manifest entry: %+v", e)
+	}
+
+	// The same manifest is stored inside the archive and as a sidecar
+	zr, err := zip.OpenReader(b.Root + "/" + key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	var embedded Manifest
+	for _, f := range zr.File {
+		if f.Name == ManifestName {
+			rc, _ := f.Open()
+			json.NewDecoder(rc).Decode(&embedded)
+			rc.Close()
+		}
+	}
+	if len(embedded.Files) != 2 || embedded.Archive != "2024-04_20240501T120000.zip" {
+		t.Errorf("embedded manifest = %+v", embedded)
+	}
+
+	if err := UploadManifest(ctx, b, key, manifest); err != nil {
+		t.Fatal(err)
+	}
+	sidecar, err := FetchManifest(ctx, b, key)
+	if err != nil || len(sidecar.Files) != 2 || sidecar.Files[1].SHA256 != manifest.Files[1].SHA256 {
+		t.Errorf("sidecar manifest = %+v, %v", sidecar, err)
+	}
+}
@@ -0,0 +1,420 @@
+package photosbackup
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	_ "modernc.org/sqlite"
+)
+
+// The Photos library database (database/Photos.sqlite inside a .photoslibrary) is a Core
+// Data store. Originals are stored as originals/<X>/<UUID>.<ext>, so files are joined to
+// their asset by the UUID in the file name. Table and join-table names vary between macOS
+// versions; the variants below cover Photos 5 (macOS 10.15) and later.
+
+// LibraryInfo is what the Photos library records about an asset.
+type LibraryInfo struct {
+	UUID     string
+	Title    string   `json:",omitempty"`
+	Favorite bool     `json:",omitempty"`
+	Hidden   bool     `json:",omitempty"`
+	Trashed  bool     `json:",omitempty"` // In Recently Deleted
+	Edited   bool     `json:",omitempty"` // Has adjustments made in Photos
+	Albums   []string `json:",omitempty"` // User albums
+	Keywords []string `json:",omitempty"`
+	People   []string `json:",omitempty"` // Named people recognized in the photo
+}
+
+// PhotosLibrary holds the LibraryInfo of every asset of a Photos library, by UUID.
+type PhotosLibrary struct {
+	assets map[string]*LibraryInfo
+}
+
+// PhotosDatabasePath returns the Photos database to read for the source (photos_database
+// in the config): "" if unset, the database of the library holding the source's path for
+// "auto", or the given path.
+func (s *Source) PhotosDatabasePath() string {
+	if strings.EqualFold(s.PhotosDatabase, "auto") {
+		return DefaultPhotosDatabase(s.Path)
+	}
+	return s.PhotosDatabase
+}
+
+// DefaultPhotosDatabase returns the path of Photos.sqlite for a library whose originals
+// are at originals, or "" if originals is not inside a .photoslibrary.
+func DefaultPhotosDatabase(originals string) string {
+	lib := filepath.Dir(filepath.Clean(originals))
+	if !strings.HasSuffix(strings.ToLower(lib), ".photoslibrary") {
+		return ""
+	}
+	return filepath.Join(lib, "database", "Photos.sqlite")
+}
+
+// LoadPhotosLibrary reads the assets, albums, keywords and people of the Photos database
+// at path. Photos may keep the database open: it is opened read-only through SQLite, which
+// takes the usual shared locks and reads changes not yet checkpointed from the -wal file.
+func LoadPhotosLibrary(path string) (*PhotosLibrary, error) {
+	db, err := openPhotosDB(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	defer db.Close()
+	l := &PhotosLibrary{assets: make(map[string]*LibraryInfo)}
+	byPK, err := l.readAssets(db)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for _, read := range []func(*photosDB, map[int64]*LibraryInfo) error{readTitlesAndKeywords, readAlbums, readPeople} {
+		if err := read(db, byPK); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	for _, info := range l.assets {
+		sort.Strings(info.Albums)
+		sort.Strings(info.Keywords)
+		sort.Strings(info.People)
+	}
+	return l, nil
+}
+
+// Len returns the number of assets.
+func (l *PhotosLibrary) Len() int {
+	if l == nil {
+		return 0
+	}
+	return len(l.assets)
+}
+
+// Asset returns the library's record of the original at path. It is safe to call on a
+// nil library, which knows no assets.
+func (l *PhotosLibrary) Asset(path string) (*LibraryInfo, bool) {
+	if l == nil {
+		return nil, false
+	}
+	base := filepath.Base(path)
+	m := uuidStemRe.FindStringSubmatch(strings.TrimSuffix(base, filepath.Ext(base)))
+	if m == nil {
+		return nil, false
+	}
+	info, ok := l.assets[strings.ToUpper(m[1])]
+	return info, ok
+}
+
+// readAssets reads the asset table and returns the assets by primary key.
+func (l *PhotosLibrary) readAssets(db *photosDB) (map[int64]*LibraryInfo, error) {
+	table := "ZASSET"
+	if !db.hasTable(table) {
+		table = "ZGENERICASSET" // macOS 10.15 and 11
+	}
+	if !db.hasTable(table) {
+		return nil, fmt.Errorf("no asset table; not a Photos library database")
+	}
+	byPK := make(map[int64]*LibraryInfo)
+	err := db.scan(table, []string{"Z_PK", "ZUUID", "ZFAVORITE", "ZHIDDEN", "ZTRASHEDSTATE", "ZHASADJUSTMENTS"}, func(row dbRow) error {
+		uuid := strings.ToUpper(row.Text("ZUUID"))
+		if uuid == "" {
+			return nil
+		}
+		info := &LibraryInfo{
+			UUID:     uuid,
+			Favorite: row.Int("ZFAVORITE") != 0,
+			Hidden:   row.Int("ZHIDDEN") != 0,
+			Trashed:  row.Int("ZTRASHEDSTATE") != 0,
+			Edited:   row.Int("ZHASADJUSTMENTS") != 0,
+		}
+		l.assets[uuid] = info
+		byPK[row.Int("Z_PK")] = info
+		return nil
+	})
+	return byPK, err
+}
+
+// readTitlesAndKeywords reads titles from the additional asset attributes and the
+// keywords attached to them.
+func readTitlesAndKeywords(db *photosDB, assets map[int64]*LibraryInfo) error {
+	if !db.hasTable("ZADDITIONALASSETATTRIBUTES") {
+		return nil
+	}
+	byAttrs := make(map[int64]*LibraryInfo)
+	err := db.scan("ZADDITIONALASSETATTRIBUTES", []string{"Z_PK", "ZASSET", "ZTITLE"}, func(row dbRow) error {
+		if info, ok := assets[row.Int("ZASSET")]; ok {
+			info.Title = row.Text("ZTITLE")
+			byAttrs[row.Int("Z_PK")] = info
+		}
+		return nil
+	})
+	if err != nil || !db.hasTable("ZKEYWORD") {
+		return err
+	}
+	keywords, err := readNames(db, "ZKEYWORD", "ZTITLE")
+	if err != nil {
+		return err
+	}
+	return scanJoinTable(db, `^Z_\d+KEYWORDS$`, `^Z_\d+ASSETATTRIBUTES$`, `^Z_\d+KEYWORDS$`, func(attrs, keyword int64) {
+		if info, ok := byAttrs[attrs]; ok && keywords[keyword] != "" {
+			info.Keywords = append(info.Keywords, keywords[keyword])
+		}
+	})
+}
+
+// readAlbums reads the user albums each asset is in. Smart, shared and trashed albums
+// are skipped.
+func readAlbums(db *photosDB, assets map[int64]*LibraryInfo) error {
+	if !db.hasTable("ZGENERICALBUM") {
+		return nil
+	}
+	albums := make(map[int64]string)
+	err := db.scan("ZGENERICALBUM", []string{"Z_PK", "ZKIND", "ZTRASHEDSTATE", "ZTITLE"}, func(row dbRow) error {
+		if row.Int("ZKIND") == 2 && row.Int("ZTRASHEDSTATE") == 0 && row.Text("ZTITLE") != "" {
+			albums[row.Int("Z_PK")] = row.Text("ZTITLE")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return scanJoinTable(db, `^Z_\d+ASSETS$`, `^Z_\d+ALBUMS$`, `^Z_\d+ASSETS$`, func(album, asset int64) {
+		if info, ok := assets[asset]; ok && albums[album] != "" {
+			info.Albums = append(info.Albums, albums[album])
+		}
+	})
+}
+
+// readPeople reads the names of the people whose faces were detected in each asset.
+func readPeople(db *photosDB, assets map[int64]*LibraryInfo) error {
+	if !db.hasTable("ZPERSON") || !db.hasTable("ZDETECTEDFACE") {
+		return nil
+	}
+	people, err := readNames(db, "ZPERSON", "ZFULLNAME", "ZDISPLAYNAME")
+	if err != nil {
+		return err
+	}
+	seen := make(map[*LibraryInfo]map[string]bool)
+	return db.scan("ZDETECTEDFACE", []string{"ZASSET", "ZPERSON", "ZASSETFORFACE", "ZPERSONFORFACE"}, func(row dbRow) error {
+		asset, person := row.Int("ZASSET"), row.Int("ZPERSON")
+		if asset == 0 {
+			asset = row.Int("ZASSETFORFACE") // macOS 13 and later
+		}
+		if person == 0 {
+			person = row.Int("ZPERSONFORFACE")
+		}
+		info, ok := assets[asset]
+		name := people[person]
+		if !ok || name == "" {
+			return nil
+		}
+		if seen[info] == nil {
+			seen[info] = make(map[string]bool)
+		}
+		if !seen[info][name] {
+			seen[info][name] = true
+			info.People = append(info.People, name)
+		}
+		return nil
+	})
+}
+
+// readNames returns the first non-empty of the given text columns of table, by primary key.
+func readNames(db *photosDB, table string, columns ...string) (map[int64]string, error) {
+	names := make(map[int64]string)
+	err := db.scan(table, append([]string{"Z_PK"}, columns...), func(row dbRow) error {
+		for _, c := range columns {
+			if name := row.Text(c); name != "" {
+				names[row.Int("Z_PK")] = name
+				break
+			}
+		}
+		return nil
+	})
+	return names, err
+}
+
+// scanJoinTable finds the many-to-many join table whose name matches tablePattern and
+// calls fn with the values of its two columns matching leftPattern and rightPattern.
+// Core Data numbers these tables and columns by entity, e.g. Z_28ASSETS(Z_28ALBUMS,
+// Z_3ASSETS), and the numbers differ between versions.
+func scanJoinTable(db *photosDB, tablePattern, leftPattern, rightPattern string, fn func(left, right int64)) error {
+	tableRe := regexp.MustCompile(tablePattern)
+	leftRe, rightRe := regexp.MustCompile(leftPattern), regexp.MustCompile(rightPattern)
+	names, err := db.tableNames()
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+	for _, table := range names {
+		if !tableRe.MatchString(table) {
+			continue
+		}
+		var left, right string
+		columns, err := db.columns(table)
+		if err != nil {
+			return err
+		}
+		for _, c := range columns {
+			upper := strings.ToUpper(c)
+			switch {
+			case left == "" && leftRe.MatchString(upper):
+				left = c
+			case right == "" && rightRe.MatchString(upper):
+				right = c
+			}
+		}
+		if left == "" || right == "" {
+			continue
+		}
+		return db.scan(table, []string{left, right}, func(row dbRow) error {
+			fn(row.Int(left), row.Int(right))
+			return nil
+		})
+	}
+	return nil
+}
+
+// photosDB is a Photos database opened read-only, with the names of its tables.
+type photosDB struct {
+	*sql.DB
+	tables map[string]bool // Upper-cased
+}
+
+// dbRow is one row of a scan, by upper-cased column name.
+type dbRow map[string]any
+
+// openPhotosDB opens the SQLite database at path read-only and reads its table names.
+func openPhotosDB(path string) (*photosDB, error) {
+	// sql.Open does not touch the file, and SQLite would create a missing one
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	// The driver hands "file:" URIs to SQLite as they are, which opens them read-only
+	dsn := (&url.URL{Scheme: "file", OmitHost: true, Path: abs, RawQuery: "mode=ro"}).String()
+	sqlDB, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db := &photosDB{DB: sqlDB, tables: make(map[string]bool)}
+	names, err := db.tableNames()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	for _, name := range names {
+		db.tables[name] = true
+	}
+	return db, nil
+}
+
+// hasTable reports whether the database has a table called name (case-insensitive).
+func (db *photosDB) hasTable(name string) bool {
+	return db.tables[strings.ToUpper(name)]
+}
+
+// tableNames returns the names of all tables, upper-cased.
+func (db *photosDB) tableNames() ([]string, error) {
+	return db.queryStrings(`SELECT upper(name) FROM sqlite_schema WHERE type = 'table'`)
+}
+
+// columns returns the column names of a table, or none if there is no such table.
+func (db *photosDB) columns(table string) ([]string, error) {
+	return db.queryStrings(`SELECT name FROM pragma_table_info(?)`, table)
+}
+
+// queryStrings runs a query returning one text column.
+func (db *photosDB) queryStrings(query string, args ...any) ([]string, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var values []string
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, rows.Err()
+}
+
+// scan calls fn for every row of table with the given columns. Columns the table lacks,
+// as schemas differ between macOS versions, read as zero.
+func (db *photosDB) scan(table string, columns []string, fn func(dbRow) error) error {
+	existing, err := db.columns(table)
+	if err != nil {
+		return err
+	}
+	has := make(map[string]bool)
+	for _, c := range existing {
+		has[strings.ToUpper(c)] = true
+	}
+	var names, quoted []string
+	for _, c := range columns {
+		if has[strings.ToUpper(c)] {
+			names = append(names, strings.ToUpper(c))
+			quoted = append(quoted, quoteIdent(c))
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	rows, err := db.Query("SELECT " + strings.Join(quoted, ", ") + " FROM " + quoteIdent(table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	values := make([]any, len(names))
+	ptrs := make([]any, len(names))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(ptrs...); err != nil {
+			return err
+		}
+		row := make(dbRow, len(names))
+		for i, name := range names {
+			row[name] = values[i]
+		}
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// quoteIdent quotes a table or column name for use in a query.
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// Int returns the integer value of column name, or 0 if it is missing, NULL or not a number.
+func (r dbRow) Int(name string) int64 {
+	switch v := r[strings.ToUpper(name)].(type) {
+	case int64:
+		return v
+	case float64:
+		return int64(v)
+	}
+	return 0
+}
+
+// Text returns the text value of column name, or "" if it is missing, NULL or not text.
+func (r dbRow) Text(name string) string {
+	switch v := r[strings.ToUpper(name)].(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	}
+	return ""
+}
@@ -0,0 +1,119 @@
+package photosbackup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testdata/Photos.sqlite has 60 assets, spread over several b-tree pages of 1 KiB. Its
+// -wal file holds an uncheckpointed change that marks the second asset as a favorite.
+func libraryUUID(i int) string {
+	return fmt.Sprintf("%08X-0000-4000-8000-%012X", 0x1A2B3C00+i, i)
+}
+
+// photosFixture copies testdata/Photos.sqlite and its -wal file to a temporary directory,
+// as SQLite adds a -shm file next to the database it reads.
+func photosFixture(t *testing.T) string {
+	dir := t.TempDir()
+	for _, name := range []string{"Photos.sqlite", "Photos.sqlite-wal"} {
+		b, err := os.ReadFile(filepath.Join("testdata", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.WriteFile(filepath.Join(dir, name), b, 0644)
+	}
+	return filepath.Join(dir, "Photos.sqlite")
+}
+
+func TestLoadPhotosLibrary(t *testing.T) {
+	lib, err := LoadPhotosLibrary(photosFixture(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lib.Len() != 60 {
+		t.Fatalf("Len = %d, want 60", lib.Len())
+	}
+	first, ok := lib.Asset("/lib/originals/1/" + strings.ToLower(libraryUUID(1)) + ".jpeg")
+	if !ok {
+		t.Fatal("asset 1 not found")
+	}
+	want := fmt.Sprintf("%+v", LibraryInfo{
+		UUID: libraryUUID(1), Title: "Sunset at the pier", Favorite: true, Edited: true,
+		Albums: []string{"Best of", "Holidays"}, Keywords: []string{"beach", "family"}, People: []string{"Ann Example", "Bo"},
+	})
+	if got := fmt.Sprintf("%+v", *first); got != want {
+		t.Errorf("asset 1 = %s\nwant %s", got, want)
+	}
+
+	// The title overflows its page, and the favorite flag is only in the -wal file
+	second, _ := lib.Asset(libraryUUID(2) + "_3.mov")
+	if second == nil || len(second.Title) != 1513 || !second.Favorite || fmt.Sprint(second.Albums) != "[Holidays]" {
+		t.Errorf("asset 2 = %+v", second)
+	}
+	if a, _ := lib.Asset(libraryUUID(3) + ".heic"); a == nil || !a.Trashed {
+		t.Errorf("asset 3 = %+v, want trashed", a)
+	}
+	if a, _ := lib.Asset(libraryUUID(4) + ".heic"); a == nil || !a.Hidden {
+		t.Errorf("asset 4 = %+v, want hidden", a)
+	}
+	if _, ok := lib.Asset(libraryUUID(60) + ".jpeg"); !ok {
+		t.Error("asset 60 not found")
+	}
+	if _, ok := lib.Asset("IMG_0001.JPG"); ok {
+		t.Error("found an asset for a file without a UUID name")
+	}
+}
+
+func TestLoadPhotosLibraryRejectsOtherFiles(t *testing.T) {
+	if _, err := LoadPhotosLibrary("testdata/rich.jpg"); err == nil {
+		t.Error("expected an error for a file that is not a SQLite database")
+	}
+	missing := filepath.Join(t.TempDir(), "Photos.sqlite")
+	if _, err := LoadPhotosLibrary(missing); err == nil {
+		t.Error("expected an error for a missing database")
+	}
+	if _, err := os.Stat(missing); err == nil {
+		t.Error("a missing database was created")
+	}
+}
+
+func TestFindNewPhotosAddsLibraryInfo(t *testing.T) {
+	lib, err := LoadPhotosLibrary(photosFixture(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, libraryUUID(1)+".jpeg"), []byte("favorite"), 0644)
+	os.WriteFile(filepath.Join(dir, libraryUUID(3)+".jpeg"), []byte("trashed"), 0644)
+	os.WriteFile(filepath.Join(dir, "IMG_0001.jpeg"), []byte("not in the library"), 0644)
+
+	res := scanLibrary(t, dir, ScanOptions{AllowedExtensions: []string{".jpeg"}, Library: lib, ExcludeTrashed: true})
+	if len(res.Files) != 2 || res.Trashed != 1 {
+		t.Fatalf("%d files, %d trashed", len(res.Files), res.Trashed)
+	}
+	for _, f := range res.Files {
+		inLibrary := strings.HasPrefix(filepath.Base(f.Path), libraryUUID(1))
+		if inLibrary != (f.Library != nil) || (inLibrary && f.Library.Title != "Sunset at the pier") {
+			t.Errorf("%s: Library = %+v", f.Path, f.Library)
+		}
+	}
+
+	// Without ExcludeTrashed the trashed photo is backed up and marked as such
+	res = scanLibrary(t, dir, ScanOptions{AllowedExtensions: []string{".jpeg"}, Library: lib})
+	if len(res.Files) != 3 || res.Trashed != 0 {
+		t.Errorf("%d files, %d trashed", len(res.Files), res.Trashed)
+	}
+}
+
+func TestDefaultPhotosDatabase(t *testing.T) {
+	got := DefaultPhotosDatabase("/Users/me/Pictures/Photos Library.photoslibrary/originals/")
+	if got != "/Users/me/Pictures/Photos Library.photoslibrary/database/Photos.sqlite" {
+		t.Errorf("DefaultPhotosDatabase = %q", got)
+	}
+	if got := DefaultPhotosDatabase("/Volumes/photos"); got != "" {
+		t.Errorf("DefaultPhotosDatabase outside a library = %q", got)
+	}
+}
@@ -4,47 +4,59 @@ import (
 	"archive/zip"
 	"context"
 	"crypto/sha256"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 	"time"
 
-	"gopkg.in/yaml.v3"
-
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/rwcarlsen/goexif/exif"
 )
 
 // Config holds configuration for the backup utility.
 type Config struct {
-	S3Bucket             string   `yaml:"s3_bucket"`
-	PhotosLibrary        string   `yaml:"photos_library_path"`
-	ZipFileName          string   `yaml:"zip_file_name"`
-	LastUploadFile       string   `yaml:"last_upload_file"`
-	S3KeyFormat          string   `yaml:"s3_key_format"`   // e.g. "{year}/{zip}"
-	LogLevel             string   `yaml:"log_level"`       // e.g. "info", "warn", "error"
-	Region               string   `yaml:"region"`          // AWS region
-	TestModeLimit        int      `yaml:"test_mode_limit"` // Number of files to process in test mode
-	StorageClass         string   `yaml:"storage_class"`   // S3 storage class: STANDARD, GLACIER, etc.
-	AllowedExtensions    []string `yaml:"allowed_extensions"`
-	MaxConcurrentUploads int      `yaml:"max_concurrent_uploads"`
+	S3Bucket             string        `yaml:"s3_bucket"`
+	PhotosLibrary        string        `yaml:"photos_library_path"`
+	ZipFileName          string        `yaml:"zip_file_name"`
+	LastUploadFile       string        `yaml:"last_upload_file"`
+	S3KeyFormat          string        `yaml:"s3_key_format"`        // Key template, e.g. "{hostname}/{year}/{month}/{zip}"
+	Hostname             string        `yaml:"hostname"`             // Name of this machine for {hostname} (default: the host name up to the first dot)
+	LogLevel             string        `yaml:"log_level"`            // e.g. "info", "warn", "error"
+	Region               string        `yaml:"region"`               // AWS region
+	TestModeLimit        int           `yaml:"test_mode_limit"`      // Number of files to process in test mode
+	StorageClass         string        `yaml:"storage_class"`        // S3 storage class: STANDARD, GLACIER, etc.
+	StoragePricePerGB    float64       `yaml:"storage_price_per_gb"` // USD per GB-month for dry-run cost estimates (default: us-east-1 price of storage_class)
+	AllowedExtensions    []string      `yaml:"allowed_extensions"`
+	Rules                []Rule        `yaml:"rules"` // Ordered include/exclude rules, evaluated before allowed_extensions
+	MaxConcurrentUploads int           `yaml:"max_concurrent_uploads"`
+	Backend              BackendConfig `yaml:"backend"`             // Storage target; S3 unless backend.type is "local"
+	UploadPartSizeMB     int           `yaml:"upload_part_size_mb"` // Smallest multipart upload part size in MiB (minimum 5); large archives use larger parts
+	CatalogFile          string        `yaml:"catalog_file"`        // Catalog of backed-up files, e.g. "catalog.db"
+	TimeZone             string        `yaml:"time_zone"`           // Zone of capture times that record none, e.g. "Europe/Berlin" (default: local)
+	BucketTimeZone       string        `yaml:"bucket_time_zone"`    // Zone for month grouping: "capture" (default) or e.g. "UTC"
+	ScanCacheFile        string        `yaml:"scan_cache_file"`     // Cache of parsed photo metadata, e.g. "scan_cache.json"
+	ScanWorkers          int           `yaml:"scan_workers"`        // Files hashed and parsed concurrently while scanning (default: number of CPUs)
+	SidecarExtensions    []string      `yaml:"sidecar_extensions"`  // Files backed up with the photo they belong to (default: .xmp, .aae)
+	PhotosDatabase       string        `yaml:"photos_database"`     // Photos.sqlite to read albums, favorites etc. from; "auto" for the one next to photos_library_path
+	ExcludeTrashed       bool          `yaml:"exclude_trashed"`     // Skip photos in Recently Deleted (requires photos_database)
+	SniffContent         bool          `yaml:"sniff_content"`       // Recognize photos and videos by content instead of extension
+	Sources              []Source      `yaml:"sources"`             // Trees to back up, instead of photos_library_path
 }
 
-// LoadConfig loads the YAML config file.
+// LoadConfig loads the YAML config file. Keys that are not settings, such as a misspelt
+// one, are errors; Validate checks the values.
 func LoadConfig(path string) (*Config, error) {
 	b, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
 	var cfg Config
-	if err := yaml.Unmarshal(b, &cfg); err != nil {
+	if _, err := decodeConfig(b, &cfg, Settings()); err != nil {
 		return nil, err
 	}
 	return &cfg, nil
@@ -69,168 +81,251 @@ func UpdateLastUploadTime(path string) {
 	_ = os.WriteFile(path, []byte(now), 0644)
 }
 
+// PhotoMeta is the metadata of a photo or video. Fields that are not known are left zero.
 type PhotoMeta struct {
-	Path      string
-	Taken     time.Time
-	Camera    string
-	Latitude  float64
-	Longitude float64
+	Path         string
+	Taken        time.Time
+	TimeZone     string `json:",omitempty"` // UTC offset of Taken from the file, e.g. "+02:00"; empty if the default zone was used
+	Make         string
+	Camera       string  // Camera or device model
+	Lens         string  `json:",omitempty"`
+	FocalLength  float64 `json:",omitempty"` // Millimetres
+	ISO          int     `json:",omitempty"`
+	ExposureTime float64 `json:",omitempty"` // Seconds
+	FNumber      float64 `json:",omitempty"`
+	Width        int     `json:",omitempty"` // Pixels
+	Height       int     `json:",omitempty"` // Pixels
+	Orientation  int     `json:",omitempty"` // EXIF orientation, 1 (upright) to 8
+	Latitude     float64
+	Longitude    float64
+	Altitude     float64 `json:",omitempty"` // Metres above sea level
+	Duration     float64 `json:",omitempty"` // Video length in seconds
+	Size         int64
+	SHA256       string       `json:",omitempty"` // Set by FindNewPhotos
+	Primary      string       `json:",omitempty"` // For a sidecar (.xmp, .aae), the photo it belongs to
+	ContentID    string       `json:",omitempty"` // Apple content identifier shared by a Live Photo's still and video
+	LivePhoto    string       `json:",omitempty"` // The other component of a Live Photo; set by GroupPhotosByYearMonth, or by FindNewPhotos if it is not new
+	Library      *LibraryInfo `json:",omitempty"` // Albums, favorite, keywords etc. from the Photos library database
+
+	// stillTaken is the capture date of the still of a Live Photo video whose still is not
+	// new, set by FindNewPhotos, so GroupPhotosByYearMonth can store them in the same month.
+	stillTaken time.Time
 }
 
-// getPhotoMeta returns EXIF date, camera, and GPS info, or mod time if EXIF is missing.
-func getPhotoMeta(path string) (PhotoMeta, error) {
+// getPhotoMeta returns the capture date, camera, and GPS info, or mod time if they are
+// missing. Photos are read through EXIF (the Exif item for HEIF), videos through their
+// QuickTime/MP4 atoms; the format is recognized by content, or else by extension.
+// Times that carry no UTC offset are placed in zone (nil for local).
+func getPhotoMeta(path string, zone *time.Location) (PhotoMeta, error) {
+	if zone == nil {
+		zone = time.Local
+	}
 	meta := PhotoMeta{Path: path}
 	f, err := os.Open(path)
 	if err != nil {
 		return meta, err
 	}
 	defer f.Close()
-	x, err := exif.Decode(f)
-	if err == nil {
-		dt, err := x.DateTime()
-		if err == nil {
-			meta.Taken = dt
-		}
-		if cam, err := x.Get(exif.Model); err == nil {
-			meta.Camera, _ = cam.StringVal()
+	info, err := f.Stat()
+	if err != nil {
+		return meta, err
+	}
+	meta.Size = info.Size()
+	ext := strings.ToLower(filepath.Ext(path))
+	// Pick the parser by content where it is recognized, so renamed files are still read
+	if format := sniffReader(f); format != nil && len(format.Exts) > 0 && !format.hasExt(ext) {
+		ext = format.Exts[0]
+	}
+	if videoExtensions[ext] {
+		if vm, err := readVideoMeta(f, info.Size()); err == nil {
+			meta.Taken, meta.TimeZone = vm.Created, vm.TimeZone
+			if vm.TimeZone == "" {
+				meta.Taken = vm.Created.In(zone)
+			}
+			meta.Make, meta.Camera = vm.Make, vm.Model
+			if vm.HasLocation {
+				meta.Latitude, meta.Longitude, meta.Altitude = vm.Latitude, vm.Longitude, vm.Altitude
+			}
+			meta.Width, meta.Height = vm.Width, vm.Height
+			meta.Duration = vm.Duration
+			meta.ContentID = vm.ContentID
 		}
-		if lat, long, err := x.LatLong(); err == nil {
-			meta.Latitude = lat
-			meta.Longitude = long
+	} else if r, err := exifSource(f, ext); err == nil {
+		if x, err := exif.Decode(r); err == nil {
+			readExif(x, &meta, zone)
 		}
 	}
 	if meta.Taken.IsZero() {
-		info, err := os.Stat(path)
-		if err == nil {
-			meta.Taken = info.ModTime()
-		}
+		meta.Taken = info.ModTime().In(zone)
 	}
 	return meta, nil
 }
 
-// GetPhotoMetaLogged returns EXIF metadata and logs it for each photo.
-func GetPhotoMetaLogged(path string) (PhotoMeta, error) {
-	meta, err := getPhotoMeta(path)
-	if err != nil {
-		log.Printf("[ERROR] Could not extract EXIF for %s: %v", path, err)
-		return meta, err
-	}
+// LogPhotoMeta logs the metadata of a photo.
+func LogPhotoMeta(meta PhotoMeta) {
 	log.Printf("[EXIF] %s | Date: %s | Camera: %s | GPS: (%f, %f)",
 		meta.Path, meta.Taken.Format(time.RFC3339), meta.Camera, meta.Latitude, meta.Longitude)
-	return meta, nil
 }
 
-// FindNewPhotos returns a list of new photo file paths since the given time, using EXIF date if available.
-// It also returns a map of excluded file extension counts.
-func FindNewPhotos(root string, since time.Time, allowedExts []string) ([]string, map[string]int) {
-	var files []string
-	seen := make(map[string]bool)
-	excluded := make(map[string]int)
-	allowed := make(map[string]bool)
-	for _, ext := range allowedExts {
-		allowed[strings.ToLower(ext)] = true
+// GroupPhotosByYearMonth groups photos by the year and month they were taken. With a
+// nil zone the month is that of the wall clock where each photo was taken; otherwise
+// capture times are converted to zone first. The video of a Live Photo is grouped with
+// its still, whatever its own date, and both are marked with the other's path.
+func GroupPhotosByYearMonth(photos []PhotoMeta, zone *time.Location) map[string][]PhotoMeta {
+	photos = append([]PhotoMeta(nil), photos...)
+	stillTaken := make(map[string]time.Time) // Live Photo video -> date of its still
+	for _, meta := range photos {
+		if !meta.stillTaken.IsZero() {
+			stillTaken[meta.Path] = meta.stillTaken // the still was backed up earlier
+		}
 	}
-	filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
-		if err != nil {
-			return nil
+	for video, still := range pairLivePhotos(photos) {
+		photos[video].LivePhoto = photos[still].Path
+		photos[still].LivePhoto = photos[video].Path
+		stillTaken[photos[video].Path] = photos[still].Taken
+	}
+	result := make(map[string][]PhotoMeta)
+	for _, meta := range photos {
+		taken := meta.Taken
+		if t, ok := stillTaken[meta.Path]; ok {
+			taken = t
+		} else if t, ok := stillTaken[meta.Primary]; ok && meta.Primary != "" {
+			taken = t // sidecar of a Live Photo video
 		}
-		ext := strings.ToLower(filepath.Ext(path))
-		if !d.IsDir() && allowed[ext] {
-			meta, err := getPhotoMeta(path)
-			if err == nil && meta.Taken.After(since) {
-				key := fmt.Sprintf("%s-%s", meta.Taken.Format("20060102T150405"), filepath.Base(path))
-				if !seen[key] {
-					files = append(files, path)
-					seen[key] = true
-				} else {
-					log.Printf("[WARN] Duplicate photo skipped: %s", path)
-				}
-			}
-		} else if !d.IsDir() {
-			excluded[ext]++
+		if zone != nil {
+			taken = taken.In(zone)
 		}
-		return nil
-	})
-	return files, excluded
+		key := fmt.Sprintf("%04d-%02d", taken.Year(), taken.Month())
+		result[key] = append(result[key], meta)
+	}
+	return result
 }
 
-// GroupPhotosByYearMonth groups file paths by year and month using EXIF date if available.
-func GroupPhotosByYearMonth(files []string) map[string][]string {
-	result := make(map[string][]string)
-	for _, file := range files {
-		meta, err := getPhotoMeta(file)
+// WriteZip writes a zip archive of the given photos to w. The archive ends with a
+// ManifestName member describing every file, including the paths of identical copies
+// listed in duplicates that were not stored separately; the same manifest is returned.
+// Sidecars that follow their photo are named after the photo's member, so a restore
+// puts them next to it.
+func WriteZip(w io.Writer, archive string, photos []PhotoMeta, duplicates map[string][]string) (*Manifest, error) {
+	zipWriter := zip.NewWriter(w)
+	manifest := &Manifest{Archive: archive, Created: time.Now()}
+	used := map[string]bool{ManifestName: true}
+	members := make(map[string]string) // source path -> member, for naming sidecars after their photo
+	for _, meta := range photos {
+		name := filepath.Base(meta.Path)
+		if primaryMember, ok := members[meta.Primary]; ok && meta.Primary != "" {
+			name = sidecarMember(meta.Path, meta.Primary, primaryMember)
+		}
+		entry, err := addFileToZip(zipWriter, meta, uniqueMember(name, used))
 		if err != nil {
-			continue
+			return nil, err
 		}
-		key := fmt.Sprintf("%04d-%02d", meta.Taken.Year(), meta.Taken.Month())
-		result[key] = append(result[key], file)
+		members[meta.Path] = entry.Member
+		entry.Duplicates = duplicates[meta.Path]
+		manifest.Files = append(manifest.Files, entry)
 	}
-	return result
+	mw, err := zipWriter.Create(ManifestName)
+	if err != nil {
+		return nil, err
+	}
+	enc := json.NewEncoder(mw)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(manifest); err != nil {
+		return nil, err
+	}
+	return manifest, zipWriter.Close()
 }
 
-// ZipFiles zips the given files into a zip archive.
-func ZipFiles(zipName string, files []string) error {
-	zipfile, err := os.Create(zipName)
-	if err != nil {
-		return err
+// errPutReturned is handed to the zip writer when Put returns before the archive is complete.
+var errPutReturned = errors.New("upload stopped reading")
+
+// UploadZip streams a zip archive of the given photos to key without writing it to
+// local disk. It returns the checksum of the archive, computed on the fly with the part
+// size of the upload (see PutOptions.PartSize) so it can be compared with the checksum
+// the backend records, and the manifest embedded in the archive.
+func UploadZip(ctx context.Context, b Backend, key string, photos []PhotoMeta, duplicates map[string][]string, opts PutOptions) (ArchiveChecksum, *Manifest, error) {
+	pr, pw := io.Pipe()
+	partSize := uploadPartSize(b)
+	if partSize > 0 {
+		partSize = max(partSize, opts.PartSize)
 	}
-	defer zipfile.Close()
-	zipWriter := zip.NewWriter(zipfile)
-	defer zipWriter.Close()
-	for _, file := range files {
-		if err := addFileToZip(zipWriter, file); err != nil {
-			return err
+	h := newChecksumWriter(partSize)
+	var manifest *Manifest
+	zipErr := make(chan error, 1)
+	go func() {
+		var err error
+		manifest, err = WriteZip(io.MultiWriter(pw, h), path.Base(key), photos, duplicates)
+		pw.CloseWithError(err)
+		zipErr <- err
+	}()
+	putErr := b.Put(ctx, key, pr, opts)
+	pr.CloseWithError(errPutReturned) // unblock the zip writer if Put stopped reading early
+	if err := <-zipErr; err != nil {
+		if !errors.Is(err, errPutReturned) {
+			return ArchiveChecksum{}, nil, fmt.Errorf("zip: %w", err)
 		}
+		if putErr == nil {
+			return ArchiveChecksum{}, nil, fmt.Errorf("upload of %s ended before the archive was complete", key)
+		}
+	}
+	if putErr != nil {
+		return ArchiveChecksum{}, nil, putErr
 	}
-	return nil
+	return h.Sum(), manifest, nil
 }
 
-// addFileToZip adds a file to the zip archive.
-func addFileToZip(zipWriter *zip.Writer, filename string) error {
-	file, err := os.Open(filename)
+// addFileToZip adds a photo to the zip archive as member and returns its manifest entry.
+func addFileToZip(zipWriter *zip.Writer, meta PhotoMeta, member string) (ManifestEntry, error) {
+	entry := ManifestEntry{Path: meta.Path, Member: member, Meta: meta}
+	file, err := os.Open(meta.Path)
 	if err != nil {
-		return err
+		return entry, err
 	}
 	defer file.Close()
-	w, err := zipWriter.Create(filepath.Base(filename))
+	if info, err := file.Stat(); err == nil {
+		entry.ModTime = info.ModTime()
+	}
+	w, err := zipWriter.Create(member)
 	if err != nil {
-		return err
+		return entry, err
 	}
-	_, err = io.Copy(w, file)
-	return err
-}
-
-// UploadToS3 uploads the zip file to S3 using the provided context for cancellation.
-func UploadToS3(ctx context.Context, bucket, key, zipPath string, region string, storageClass string) error {
-	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region))
+	h := sha256.New()
+	entry.Size, err = io.Copy(io.MultiWriter(w, h), file)
 	if err != nil {
-		return err
+		return entry, err
 	}
-	client := s3.NewFromConfig(cfg)
-	file, err := os.Open(zipPath)
+	entry.SHA256 = fmt.Sprintf("%x", h.Sum(nil))
+	entry.Meta.Size, entry.Meta.SHA256 = entry.Size, entry.SHA256
+	return entry, nil
+}
+
+// S3Key returns the key of an archive from s3_key_format. The hostname and storage class
+// are taken from cfg unless set in v.
+func S3Key(cfg *Config, v KeyValues) (string, error) {
+	t, err := cfg.keyTemplate()
 	if err != nil {
-		return err
+		return "", err
 	}
-	defer file.Close()
-	input := &s3.PutObjectInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(key),
-		Body:   file,
+	if v.Hostname == "" {
+		v.Hostname = cfg.Hostname
 	}
-	if storageClass != "" {
-		input.StorageClass = types.StorageClass(storageClass)
+	if v.StorageClass == "" {
+		v.StorageClass = cfg.StorageClass
 	}
-	_, err = client.PutObject(ctx, input)
-	return err
+	return t.render(v)
 }
 
-// S3Key returns the S3 key for a given year, zip name, and config.
-func S3Key(cfg *Config, year, zipName string) string {
-	format := cfg.S3KeyFormat
+// keyTemplate parses s3_key_format.
+func (c *Config) keyTemplate() (keyTemplate, error) {
+	format := c.S3KeyFormat
 	if format == "" {
-		format = "{year}/{zip}"
+		format = defaultKeyFormat
+	}
+	t, err := parseKeyTemplate(format)
+	if err != nil {
+		return nil, fmt.Errorf("s3_key_format: %w", err)
 	}
-	return strings.ReplaceAll(strings.ReplaceAll(format, "{year}", year), "{zip}", zipName)
+	return t, nil
 }
 
 // FileSHA256 computes the SHA256 checksum of a local file.
@@ -246,23 +341,3 @@ func FileSHA256(path string) (string, error) {
 	}
 	return fmt.Sprintf("%x", h.Sum(nil)), nil
 }
-
-// S3SHA256 downloads the S3 object and computes its SHA256 checksum.
-func S3SHA256(ctx context.Context, cfg *Config, key string) (string, error) {
-	awsCfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(cfg.Region))
-	if err != nil {
-		return "", err
-	}
-	client := s3.NewFromConfig(awsCfg)
-	buf := manager.NewWriteAtBuffer([]byte{})
-	_, err = manager.NewDownloader(client).Download(ctx, buf, &s3.GetObjectInput{
-		Bucket: &cfg.S3Bucket,
-		Key:    &key,
-	})
-	if err != nil {
-		return "", err
-	}
-	h := sha256.New()
-	h.Write(buf.Bytes())
-	return fmt.Sprintf("%x", h.Sum(nil)), nil
-}
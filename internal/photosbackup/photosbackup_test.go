@@ -1,7 +1,9 @@
 package photosbackup
 
 import (
+	"context"
 	"os"
+	"strings"
 	"testing"
 	"time"
 )
@@ -21,9 +23,9 @@ func TestFindNewPhotosFiltersByExtension(t *testing.T) {
 	os.WriteFile(dir+"/a.jpg", []byte("test"), 0644)
 	os.WriteFile(dir+"/b.txt", []byte("test"), 0644)
 	allowed := []string{".jpg"}
-	files, excluded := FindNewPhotos(dir, time.Time{}, allowed)
-	if len(files) != 1 || excluded[".txt"] != 1 {
-		t.Errorf("Expected 1 jpg and 1 excluded txt, got files=%v, excluded=%v", files, excluded)
+	res := scanLibrary(t, dir, ScanOptions{AllowedExtensions: allowed})
+	if len(res.Files) != 1 || res.Excluded()[".txt"] != 1 {
+		t.Errorf("Expected 1 jpg and 1 excluded txt, got files=%v, excluded=%v", res.Files, res.Excluded())
 	}
 }
 
@@ -33,9 +35,39 @@ func TestGroupPhotosByYearMonth(t *testing.T) {
 	os.WriteFile(file, []byte("test"), 0644)
 	old := time.Now().AddDate(-1, 0, 0)
 	os.Chtimes(file, old, old)
-	files := []string{file}
-	groups := GroupPhotosByYearMonth(files)
-	if len(groups) == 0 {
-		t.Errorf("Expected at least one group, got %v", groups)
+	meta, err := getPhotoMeta(file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	groups := GroupPhotosByYearMonth([]PhotoMeta{meta}, nil)
+	if len(groups[old.Format("2006-01")]) != 1 {
+		t.Errorf("Expected the file in its mtime month, got %v", groups)
+	}
+}
+
+func TestUploadZipStreamsArchive(t *testing.T) {
+	ctx := context.Background()
+	b, err := NewLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	os.WriteFile(dir+"/a.jpg", []byte("photo a"), 0644)
+	os.WriteFile(dir+"/b.jpg", []byte("photo b"), 0644)
+
+	sum, _, err := UploadZip(ctx, b, "2024/2024-02.zip", []PhotoMeta{{Path: dir + "/a.jpg"}, {Path: dir + "/b.jpg"}}, nil, PutOptions{})
+	if err != nil {
+		t.Fatalf("UploadZip: %v", err)
+	}
+	if err := VerifyUpload(ctx, b, "2024/2024-02.zip", sum); err != nil {
+		t.Errorf("streamed checksum does not match stored object: %v", err)
+	}
+
+	_, _, err = UploadZip(ctx, b, "2024/2024-03.zip", []PhotoMeta{{Path: dir + "/missing.jpg"}}, nil, PutOptions{})
+	if err == nil || !strings.HasPrefix(err.Error(), "zip:") {
+		t.Errorf("expected zip error for missing file, got %v", err)
+	}
+	if _, err := b.Head(ctx, "2024/2024-03.zip"); err == nil {
+		t.Error("failed upload left a partial object behind")
 	}
 }
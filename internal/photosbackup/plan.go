@@ -0,0 +1,188 @@
+package photosbackup
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// storagePrices are the S3 list prices in USD per GB-month in us-east-1, used to estimate
+// what a run adds to the monthly bill. storage_price_per_gb overrides them.
+var storagePrices = map[string]float64{
+	"STANDARD":            0.023,
+	"INTELLIGENT_TIERING": 0.023, // frequent access tier, before objects move down
+	"STANDARD_IA":         0.0125,
+	"ONEZONE_IA":          0.01,
+	"GLACIER_IR":          0.004,
+	"GLACIER":             0.0036,
+	"DEEP_ARCHIVE":        0.00099,
+}
+
+// StoragePrice returns the price in USD per GB-month of the archives' storage class, and
+// false if it is not known: for the local backend or an unlisted class without
+// storage_price_per_gb.
+func (c *Config) StoragePrice() (float64, bool) {
+	if c.StoragePricePerGB > 0 {
+		return c.StoragePricePerGB, true
+	}
+	if c.Backend.Type == "local" {
+		return 0, false
+	}
+	class := strings.ToUpper(c.StorageClass)
+	if class == "" {
+		class = "STANDARD"
+	}
+	price, ok := storagePrices[class]
+	return price, ok
+}
+
+// Plan is what a backup run uploads, as reported by a dry run.
+type Plan struct {
+	Sources      []SourcePlan `json:"sources"`
+	Files        int          `json:"files"`
+	Bytes        int64        `json:"bytes"`
+	Archives     int          `json:"archives"`
+	StorageClass string       `json:"storage_class,omitempty"`
+	PricePerGB   float64      `json:"price_per_gb_month_usd,omitempty"` // Price the costs are estimated with
+	// MonthlyCost is the estimated storage cost of the new archives in USD per month;
+	// nil if the price of the storage class is not known.
+	MonthlyCost *float64 `json:"estimated_monthly_cost_usd,omitempty"`
+}
+
+// SourcePlan is the part of a Plan for one source.
+type SourcePlan struct {
+	Source string      `json:"source,omitempty"`
+	Path   string      `json:"path"`
+	Months []MonthPlan `json:"months"`
+	// Skipped are the months the upload state records an archive for and that have no
+	// new files. Months with new files are never skipped; they get another archive.
+	Skipped []SkippedMonth `json:"skipped_months"`
+}
+
+// MonthPlan is one archive of a Plan.
+type MonthPlan struct {
+	Month       string   `json:"month"`
+	Files       int      `json:"files"`
+	Bytes       int64    `json:"bytes"`
+	Key         string   `json:"key"`
+	MonthlyCost *float64 `json:"estimated_monthly_cost_usd,omitempty"`
+	Previous    string   `json:"previous_archive,omitempty"` // Latest archive of the month in the upload state
+}
+
+// SkippedMonth is a month that is already uploaded and has nothing new.
+type SkippedMonth struct {
+	Month   string `json:"month"`
+	Archive string `json:"archive"`
+}
+
+// Plan returns the plan of a backup run: the archives of res, and the months of the
+// upload state that the run leaves alone.
+func (r *Runner) Plan(res *BackupResult) *Plan {
+	price, known := r.cfg.StoragePrice()
+	cost := func(bytes int64) *float64 {
+		if !known {
+			return nil
+		}
+		c := float64(bytes) / (1 << 30) * price
+		return &c
+	}
+
+	plan := &Plan{StorageClass: r.cfg.StorageClass, PricePerGB: price}
+	for _, sr := range res.Sources {
+		src := sr.Source
+		months := r.state.Months(src.State)
+		sp := SourcePlan{Source: src.Name, Path: src.Path, Months: []MonthPlan{}, Skipped: []SkippedMonth{}}
+		planned := make(map[string]bool)
+		for _, a := range sr.Archives {
+			mp := MonthPlan{Month: a.Month, Files: len(a.Files), Bytes: a.Bytes, Key: a.Key, MonthlyCost: cost(a.Bytes)}
+			if value := months[a.Month]; value != "" {
+				mp.Previous, _ = src.stateKey(r.cfg, value)
+			}
+			sp.Months = append(sp.Months, mp)
+			planned[a.Month] = true
+			plan.Files += mp.Files
+			plan.Bytes += mp.Bytes
+			plan.Archives++
+		}
+		for ym, value := range months {
+			if !planned[ym] {
+				key, _ := src.stateKey(r.cfg, value)
+				sp.Skipped = append(sp.Skipped, SkippedMonth{Month: ym, Archive: key})
+			}
+		}
+		sort.Slice(sp.Skipped, func(i, j int) bool { return sp.Skipped[i].Month < sp.Skipped[j].Month })
+		plan.Sources = append(plan.Sources, sp)
+	}
+	plan.MonthlyCost = cost(plan.Bytes)
+	return plan
+}
+
+// WriteJSON writes the plan as indented JSON.
+func (p *Plan) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(p)
+}
+
+// WriteTable writes the plan as a table with one row per archive, followed by the
+// skipped months of each source.
+func (p *Plan) WriteTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SOURCE\tMONTH\tFILES\tSIZE\tCOST/MONTH\tKEY\tNOTE")
+	for _, sp := range p.Sources {
+		for _, m := range sp.Months {
+			note := ""
+			if m.Previous != "" {
+				note = "adds to " + m.Previous
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%s\t%s\n", orDefault(sp.Source, "-"), m.Month, m.Files, formatBytes(m.Bytes), formatCost(m.MonthlyCost), m.Key, note)
+		}
+	}
+	fmt.Fprintf(tw, "TOTAL\t\t%d\t%s\t%s\t%d archives\n", p.Files, formatBytes(p.Bytes), formatCost(p.MonthlyCost), p.Archives)
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if p.MonthlyCost != nil {
+		fmt.Fprintf(w, "Costs are estimated at $%g per GB-month (%s) and exclude requests and retrievals.\n", p.PricePerGB, orDefault(p.StorageClass, "storage_price_per_gb"))
+	}
+
+	for _, sp := range p.Sources {
+		if len(sp.Skipped) == 0 {
+			continue
+		}
+		label := "Months"
+		if sp.Source != "" {
+			label = "Months of " + sp.Source
+		}
+		fmt.Fprintf(w, "\n%s skipped, already uploaded with no new files (%d):\n", label, len(sp.Skipped))
+		tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		for _, s := range sp.Skipped {
+			fmt.Fprintf(tw, "  %s\t%s\n", s.Month, s.Archive)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GiB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MiB", float64(n)/(1<<20))
+	default:
+		return fmt.Sprintf("%.1f KiB", float64(n)/(1<<10))
+	}
+}
+
+func formatCost(c *float64) string {
+	if c == nil {
+		return "-"
+	}
+	return fmt.Sprintf("$%.4f", *c)
+}
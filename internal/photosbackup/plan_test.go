@@ -0,0 +1,84 @@
+package photosbackup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestRunnerPlan(t *testing.T) {
+	ctx := context.Background()
+	r, cfg := newTestRunner(t, RunOptions{Limit: 1})
+	res, err := r.Backup(ctx)
+	if err != nil || len(res.Sources[0].Archives) != 1 {
+		t.Fatalf("Backup: %+v, %v", res, err)
+	}
+	uploaded := res.Sources[0].Archives[0]
+
+	cfg.StoragePricePerGB = 0.5
+	r.Close()
+	dry, err := NewRunner(ctx, cfg, RunOptions{DryRun: true, Dir: r.opts.Dir, Out: &bytes.Buffer{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dry.Close()
+	if res, err = dry.Backup(ctx); err != nil || len(res.Sources[0].Archives) != 1 {
+		t.Fatalf("dry run: %+v, %v", res, err)
+	}
+	// An earlier archive of the month that still has new files
+	month := res.Sources[0].Archives[0].Month
+	dry.State().CompletedMonths[month] = month + "_20200101T000000.zip"
+
+	plan := dry.Plan(res)
+	if plan.Files != 1 || plan.Archives != 1 || plan.MonthlyCost == nil || len(plan.Sources) != 1 {
+		t.Fatalf("plan %+v", plan)
+	}
+	sp := plan.Sources[0]
+	if m := sp.Months[0]; m.Key != res.Sources[0].Archives[0].Key || m.Bytes != plan.Bytes || m.Previous != month[:4]+"/"+month+"_20200101T000000.zip" {
+		t.Errorf("month plan %+v", m)
+	}
+	if want := float64(plan.Bytes) / (1 << 30) * 0.5; *plan.MonthlyCost != want {
+		t.Errorf("cost %v, want %v", *plan.MonthlyCost, want)
+	}
+	if len(sp.Skipped) != 1 || sp.Skipped[0].Month != uploaded.Month || sp.Skipped[0].Archive != uploaded.Key {
+		t.Errorf("skipped %+v, want %s", sp.Skipped, uploaded.Key)
+	}
+
+	var table bytes.Buffer
+	if err := plan.WriteTable(&table); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"SOURCE", month, "adds to " + sp.Months[0].Previous, "TOTAL", "$0.5 per GB-month", "skipped", uploaded.Key} {
+		if !strings.Contains(table.String(), want) {
+			t.Errorf("table lacks %q:\n%s", want, table.String())
+		}
+	}
+	var js bytes.Buffer
+	if err := plan.WriteJSON(&js); err != nil {
+		t.Fatal(err)
+	}
+	var decoded Plan
+	if err := json.Unmarshal(js.Bytes(), &decoded); err != nil || decoded.Sources[0].Skipped[0] != sp.Skipped[0] || *decoded.MonthlyCost != *plan.MonthlyCost {
+		t.Errorf("JSON %s: %v", js.String(), err)
+	}
+}
+
+func TestStoragePrice(t *testing.T) {
+	for _, tt := range []struct {
+		cfg   Config
+		price float64
+		known bool
+	}{
+		{Config{}, 0.023, true},
+		{Config{StorageClass: "deep_archive"}, 0.00099, true},
+		{Config{StorageClass: "GLACIER", StoragePricePerGB: 0.0045}, 0.0045, true},
+		{Config{StorageClass: "EXPRESS_ONEZONE"}, 0, false},
+		{Config{Backend: BackendConfig{Type: "local"}}, 0, false},
+	} {
+		if price, known := tt.cfg.StoragePrice(); price != tt.price || known != tt.known {
+			t.Errorf("%+v: StoragePrice() = %v, %v", tt.cfg, price, known)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package photosbackup
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRestoreArchiveSkipsUnchangedFiles(t *testing.T) {
+	ctx := context.Background()
+	b, err := NewLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := t.TempDir()
+	os.WriteFile(src+"/a.jpg", []byte("photo a"), 0644)
+	os.WriteFile(src+"/b.mov", []byte("video b"), 0644)
+	photos := []PhotoMeta{{Path: src + "/a.jpg"}, {Path: src + "/b.mov"}}
+	for _, key := range []string{"2023/2023-05_20230601T120000.zip", "2024/2024-01_20240201T120000.zip"} {
+		if _, _, err := UploadZip(ctx, b, key, photos, nil, PutOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := &Config{PhotosLibrary: src}
+	sources, _ := cfg.BackupSources()
+	archives, err := SourceArchives(ctx, b, cfg, sources[0], "2023-01", "2023-12")
+	if err != nil || len(archives) != 1 || archives[0].Key != "2023/2023-05_20230601T120000.zip" {
+		t.Fatalf("SourceArchives returned %v, %v", archives, err)
+	}
+	keys := []string{archives[0].Key}
+
+	dest := t.TempDir()
+	var stats RestoreStats
+	if err := RestoreArchive(ctx, b, keys[0], dest, "", nil, &stats); err != nil {
+		t.Fatalf("RestoreArchive: %v", err)
+	}
+	if got, _ := os.ReadFile(dest + "/a.jpg"); string(got) != "photo a" {
+		t.Errorf("restored a.jpg = %q", got)
+	}
+
+	os.WriteFile(dest+"/b.mov", []byte("changed"), 0644)
+	stats = RestoreStats{}
+	if err := RestoreArchive(ctx, b, keys[0], dest, "", nil, &stats); err != nil {
+		t.Fatalf("RestoreArchive: %v", err)
+	}
+	if stats.Restored != 1 || stats.Skipped != 1 {
+		t.Errorf("expected 1 restored and 1 skipped, got %+v", stats)
+	}
+	if got, _ := os.ReadFile(dest + "/b.mov"); string(got) != "video b" {
+		t.Errorf("b.mov not restored, got %q", got)
+	}
+}
+
+func TestRestoreArchiveKeepsCopiesInTheirDirectories(t *testing.T) {
+	ctx := context.Background()
+	b, _ := NewLocalBackend(t.TempDir())
+	src := t.TempDir()
+	for _, dir := range []string{"2023/trip", "2023/backup", "later"} {
+		os.MkdirAll(filepath.Join(src, dir), 0755)
+	}
+	os.WriteFile(filepath.Join(src, "2023/trip/IMG_1.jpg"), []byte("photo"), 0644)
+	os.WriteFile(filepath.Join(src, "2023/backup/IMG_1.jpg"), []byte("photo"), 0644)
+	res := scanLibrary(t, src, ScanOptions{AllowedExtensions: []string{".jpg"}})
+	if len(res.Files) != 1 {
+		t.Fatalf("files %v", res.Files)
+	}
+	key := "2023/2023-05_20230601T120000.zip"
+	if _, _, err := UploadZip(ctx, b, key, res.Files, res.Duplicates, PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A copy found by a later run, recorded in the catalog
+	aliases := map[string][]string{"IMG_1.jpg": {filepath.Join(src, "later/IMG_1.jpg")}}
+	dest := t.TempDir()
+	var stats RestoreStats
+	if err := RestoreArchive(ctx, b, key, dest, src, aliases, &stats); err != nil {
+		t.Fatal(err)
+	}
+	copied := strings.TrimPrefix(res.Duplicates[res.Files[0].Path][0], src+"/")
+	for _, name := range []string{"IMG_1.jpg", copied, "later/IMG_1.jpg"} {
+		if got, _ := os.ReadFile(filepath.Join(dest, name)); string(got) != "photo" {
+			t.Errorf("%s restored as %q", name, got)
+		}
+	}
+	if stats.Restored != 3 {
+		t.Errorf("stats %+v", stats)
+	}
+}
+
+func TestSameContentPrefersSHA256(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.jpg")
+	os.WriteFile(path, []byte("local photo"), 0644)
+	// A member whose size and CRC-32 match the local file, but not its content
+	f := &zip.File{FileHeader: zip.FileHeader{CRC32: crc32.ChecksumIEEE([]byte("local photo")), UncompressedSize64: 11}}
+	other := fmt.Sprintf("%x", sha256.Sum256([]byte("other photo")))
+	if same, err := sameContent(path, f, other); same || err != nil {
+		t.Errorf("sameContent with the manifest's SHA256 = %v, %v", same, err)
+	}
+	local, _ := FileSHA256(path)
+	if same, _ := sameContent(path, f, local); !same {
+		t.Error("file with the manifest's SHA256 not recognized")
+	}
+	if same, _ := sameContent(path, f, ""); !same {
+		t.Error("without a manifest, size and CRC-32 are compared")
+	}
+}
+
+// compositeBackend reports a composite checksum over parts of partSize, as S3 does for
+// multipart uploads, while claiming to upload in parts of uploadSize.
+type compositeBackend struct {
+	Backend
+	partSize, uploadSize int64
+	tamper               bool
+}
+
+func (b compositeBackend) Head(ctx context.Context, key string) (ObjectInfo, error) {
+	info, err := b.Backend.Head(ctx, key)
+	if err != nil {
+		return info, err
+	}
+	body, err := b.Get(ctx, key)
+	if err != nil {
+		return info, err
+	}
+	defer body.Close()
+	cw := newChecksumWriter(b.partSize)
+	io.Copy(cw, body)
+	info.ChecksumSHA256 = cw.Sum().Composite
+	if b.tamper {
+		info.ChecksumSHA256 = "AAAA" + info.ChecksumSHA256[4:]
+	}
+	return info, nil
+}
+
+func (b compositeBackend) UploadPartSize() int64 { return b.uploadSize }
+
+// sizedBackend also tells the part size of each object, as GetObjectAttributes does.
+type sizedBackend struct{ compositeBackend }
+
+func (b sizedBackend) ObjectPartSize(ctx context.Context, key string) (int64, error) {
+	return b.partSize, nil
+}
+
+func TestDownloadArchiveWithOtherPartSize(t *testing.T) {
+	ctx := context.Background()
+	b, err := NewLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := "2023/2023-05_20230601T120000.zip"
+	if _, _, err := UploadZip(ctx, b, key, []PhotoMeta{{Path: "testdata/rich.jpg"}}, nil, PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Uploaded in parts of 256 bytes, now configured for 5 MiB: the zip CRCs still check it
+	if n, err := VerifyArchive(ctx, compositeBackend{b, 256, 5 << 20, false}, key); err != nil || n != 1 {
+		t.Errorf("VerifyArchive = %d, %v", n, err)
+	}
+	// Where the backend tells the part size, the checksum is checked
+	if _, err := VerifyArchive(ctx, sizedBackend{compositeBackend{b, 256, 5 << 20, true}}, key); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("VerifyArchive of a tampered checksum = %v", err)
+	}
+	if _, err := VerifyArchive(ctx, sizedBackend{compositeBackend{b, 256, 5 << 20, false}}, key); err != nil {
+		t.Errorf("VerifyArchive = %v", err)
+	}
+}
@@ -0,0 +1,302 @@
+package photosbackup
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Rule is an include or exclude rule from the config. A file matches a rule when it meets
+// every condition the rule sets. Rules are evaluated in order and the first match decides;
+// files matching no rule are included if their extension is in allowed_extensions or
+// sidecar_extensions (or, with sniff_content, if their content is an allowed format).
+type Rule struct {
+	Name   string `yaml:"name"`   // Shown in the scan summary (default: the rule's conditions)
+	Action string `yaml:"action"` // "include" or "exclude"
+	// Glob is matched against the path relative to the library, with "/" separators.
+	// "**" matches any number of directories. A pattern without "/" matches the file name.
+	Glob           string   `yaml:"glob"`
+	Regex          string   `yaml:"regex"`           // Matched against the relative path, with "/" separators
+	Extensions     []string `yaml:"extensions"`      // e.g. [.png, .gif]
+	MinSize        string   `yaml:"min_size"`        // e.g. "100KB", "5MiB"
+	MaxSize        string   `yaml:"max_size"`        // Inclusive
+	ModifiedBefore string   `yaml:"modified_before"` // "2006-01-02" (local time) or RFC 3339
+	ModifiedAfter  string   `yaml:"modified_after"`
+	// Hidden, if set, matches files whose name or a parent directory starts with "."
+	// (true) or files that are not hidden (false).
+	Hidden *bool `yaml:"hidden"`
+}
+
+// RuleMatch counts the files a rule decided during a scan.
+type RuleMatch struct {
+	Rule    string
+	Exclude bool
+	Files   int
+	ByExt   map[string]int // Files by extension
+}
+
+// Names of the implicit rules applied to files that match no configured rule. The last
+// two are only used when scanning with content sniffing.
+const (
+	RuleAllowedExtensions   = "allowed_extensions"
+	RuleSidecarExtensions   = "sidecar_extensions"
+	RuleOtherExtensions     = "other extensions"
+	RuleDetectedContent     = "detected by content"
+	RuleUnrecognizedContent = "unrecognized content"
+)
+
+// RuleSet is a compiled list of rules.
+type RuleSet struct {
+	rules []compiledRule
+}
+
+type compiledRule struct {
+	name       string
+	exclude    bool
+	glob       []string // pattern split at "/"; nil if unset
+	baseOnly   bool     // glob has no "/" and is matched against the file name
+	regex      *regexp.Regexp
+	extensions map[string]bool
+	minSize    int64 // -1 if unset
+	maxSize    int64 // -1 if unset
+	before     time.Time
+	after      time.Time
+	hidden     *bool
+}
+
+// CompileRules checks and compiles rules. A nil or empty list gives an empty set, which
+// leaves the decision to the allowed extensions.
+func CompileRules(rules []Rule) (*RuleSet, error) {
+	rs := &RuleSet{}
+	for i, r := range rules {
+		c, err := compileRule(r)
+		if err != nil {
+			return nil, fmt.Errorf("rules[%d]: %w", i, err)
+		}
+		rs.rules = append(rs.rules, c)
+	}
+	return rs, nil
+}
+
+func compileRule(r Rule) (compiledRule, error) {
+	c := compiledRule{name: r.Name, minSize: -1, maxSize: -1, hidden: r.Hidden}
+	switch strings.ToLower(r.Action) {
+	case "include":
+	case "exclude":
+		c.exclude = true
+	default:
+		return c, fmt.Errorf("action must be include or exclude, not %q", r.Action)
+	}
+	var conds []string
+	if r.Glob != "" {
+		if _, err := path.Match(strings.ReplaceAll(r.Glob, "**", "*"), ""); err != nil {
+			return c, fmt.Errorf("glob %q: %w", r.Glob, err)
+		}
+		c.baseOnly = !strings.Contains(r.Glob, "/")
+		c.glob = strings.Split(strings.Trim(r.Glob, "/"), "/")
+		conds = append(conds, "glob "+r.Glob)
+	}
+	if r.Regex != "" {
+		re, err := regexp.Compile(r.Regex)
+		if err != nil {
+			return c, fmt.Errorf("regex: %w", err)
+		}
+		c.regex = re
+		conds = append(conds, "regex "+r.Regex)
+	}
+	if len(r.Extensions) > 0 {
+		c.extensions = make(map[string]bool)
+		for _, ext := range r.Extensions {
+			c.extensions[strings.ToLower(ext)] = true
+		}
+		conds = append(conds, "extensions "+strings.Join(r.Extensions, ","))
+	}
+	var err error
+	if r.MinSize != "" {
+		if c.minSize, err = parseByteSize(r.MinSize); err != nil {
+			return c, fmt.Errorf("min_size: %w", err)
+		}
+		conds = append(conds, "min_size "+r.MinSize)
+	}
+	if r.MaxSize != "" {
+		if c.maxSize, err = parseByteSize(r.MaxSize); err != nil {
+			return c, fmt.Errorf("max_size: %w", err)
+		}
+		conds = append(conds, "max_size "+r.MaxSize)
+	}
+	if r.ModifiedBefore != "" {
+		if c.before, err = parseRuleTime(r.ModifiedBefore); err != nil {
+			return c, fmt.Errorf("modified_before: %w", err)
+		}
+		conds = append(conds, "modified_before "+r.ModifiedBefore)
+	}
+	if r.ModifiedAfter != "" {
+		if c.after, err = parseRuleTime(r.ModifiedAfter); err != nil {
+			return c, fmt.Errorf("modified_after: %w", err)
+		}
+		conds = append(conds, "modified_after "+r.ModifiedAfter)
+	}
+	if r.Hidden != nil {
+		conds = append(conds, "hidden "+strconv.FormatBool(*r.Hidden))
+	}
+	if len(conds) == 0 {
+		return c, errors.New("rule has no conditions")
+	}
+	if c.name == "" {
+		c.name = strings.ToLower(r.Action) + " " + strings.Join(conds, ", ")
+	}
+	return c, nil
+}
+
+// Len returns the number of rules.
+func (rs *RuleSet) Len() int {
+	if rs == nil {
+		return 0
+	}
+	return len(rs.rules)
+}
+
+// newRuleMatches returns a zero count for every rule, followed by the implicit rules.
+func (rs *RuleSet) newRuleMatches() []RuleMatch {
+	var m []RuleMatch
+	if rs != nil {
+		for _, r := range rs.rules {
+			m = append(m, RuleMatch{Rule: r.name, Exclude: r.exclude, ByExt: make(map[string]int)})
+		}
+	}
+	return append(m,
+		RuleMatch{Rule: RuleAllowedExtensions, ByExt: make(map[string]int)},
+		RuleMatch{Rule: RuleSidecarExtensions, ByExt: make(map[string]int)},
+		RuleMatch{Rule: RuleOtherExtensions, Exclude: true, ByExt: make(map[string]int)},
+		RuleMatch{Rule: RuleDetectedContent, ByExt: make(map[string]int)},
+		RuleMatch{Rule: RuleUnrecognizedContent, Exclude: true, ByExt: make(map[string]int)})
+}
+
+// match returns the index of the first rule that rel (the slash-separated path relative
+// to the library) matches. d is only asked for its FileInfo by size and time conditions.
+func (rs *RuleSet) match(rel string, d fs.DirEntry) (int, bool) {
+	if rs == nil {
+		return 0, false
+	}
+	var info fs.FileInfo
+	stat := func() fs.FileInfo {
+		if info == nil {
+			info, _ = d.Info()
+		}
+		return info
+	}
+	for i, r := range rs.rules {
+		if r.matches(rel, stat) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+func (r *compiledRule) matches(rel string, stat func() fs.FileInfo) bool {
+	if r.glob != nil {
+		if r.baseOnly {
+			if ok, _ := path.Match(r.glob[0], path.Base(rel)); !ok {
+				return false
+			}
+		} else if !matchGlob(r.glob, strings.Split(rel, "/")) {
+			return false
+		}
+	}
+	if r.regex != nil && !r.regex.MatchString(rel) {
+		return false
+	}
+	if r.extensions != nil && !r.extensions[strings.ToLower(path.Ext(rel))] {
+		return false
+	}
+	if r.hidden != nil && isHiddenPath(rel) != *r.hidden {
+		return false
+	}
+	if r.minSize < 0 && r.maxSize < 0 && r.before.IsZero() && r.after.IsZero() {
+		return true
+	}
+	info := stat()
+	if info == nil {
+		return false
+	}
+	if (r.minSize >= 0 && info.Size() < r.minSize) || (r.maxSize >= 0 && info.Size() > r.maxSize) {
+		return false
+	}
+	if (!r.before.IsZero() && !info.ModTime().Before(r.before)) || (!r.after.IsZero() && !info.ModTime().After(r.after)) {
+		return false
+	}
+	return true
+}
+
+// matchGlob matches path segments against pattern segments, where "**" matches any
+// number of segments and other segments use path.Match.
+func matchGlob(pattern, segs []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(segs); i++ {
+				if matchGlob(pattern[1:], segs[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(segs) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], segs[0]); !ok {
+			return false
+		}
+		pattern, segs = pattern[1:], segs[1:]
+	}
+	return len(segs) == 0
+}
+
+// isHiddenPath reports whether the file or one of its parent directories starts with ".".
+func isHiddenPath(rel string) bool {
+	for _, seg := range strings.Split(rel, "/") {
+		if strings.HasPrefix(seg, ".") && seg != "." && seg != ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// byteUnits are the size suffixes accepted in rules, longest first.
+var byteUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"KIB", 1 << 10}, {"MIB", 1 << 20}, {"GIB", 1 << 30}, {"TIB", 1 << 40},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+	{"B", 1},
+}
+
+// parseByteSize parses a size such as "512", "100KB" or "1.5GiB".
+func parseByteSize(s string) (int64, error) {
+	upper := strings.ToUpper(strings.TrimSpace(s))
+	unit := int64(1)
+	for _, u := range byteUnits {
+		if strings.HasSuffix(upper, u.suffix) {
+			upper, unit = strings.TrimSpace(strings.TrimSuffix(upper, u.suffix)), u.size
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(upper, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * float64(unit)), nil
+}
+
+// parseRuleTime parses a date ("2006-01-02", local midnight) or an RFC 3339 time.
+func parseRuleTime(s string) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
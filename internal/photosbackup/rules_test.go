@@ -0,0 +1,119 @@
+package photosbackup
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern, path string
+		want          bool
+	}{
+		{"**/resources/derivatives/**", "resources/derivatives/a/b.jpg", true},
+		{"**/resources/derivatives/**", "2024/resources/derivatives/b.jpg", true},
+		{"**/resources/derivatives/**", "resources/b.jpg", false},
+		{"Screenshots/*.png", "Screenshots/s.png", true},
+		{"Screenshots/*.png", "Screenshots/sub/s.png", false},
+		{"**/*.png", "s.png", true},
+		{"a/**/b", "a/b", true},
+		{"a/**/b", "a/x/y/b", true},
+	}
+	for _, tt := range tests {
+		if got := matchGlob(strings.Split(tt.pattern, "/"), strings.Split(tt.path, "/")); got != tt.want {
+			t.Errorf("matchGlob(%q, %q) = %v, want %v", tt.pattern, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	for s, want := range map[string]int64{"512": 512, "100KB": 100000, "5MiB": 5 << 20, "1.5 gib": 3 << 29, "10b": 10} {
+		if got, err := parseByteSize(s); err != nil || got != want {
+			t.Errorf("parseByteSize(%q) = %d, %v, want %d", s, got, err, want)
+		}
+	}
+	if _, err := parseByteSize("ten MB"); err == nil {
+		t.Error("expected an error for an invalid size")
+	}
+}
+
+func TestCompileRulesRejectsInvalidRules(t *testing.T) {
+	for _, r := range []Rule{
+		{Action: "skip", Glob: "*.png"},
+		{Action: "exclude"},
+		{Action: "exclude", Regex: "("},
+		{Action: "include", MinSize: "big"},
+		{Action: "include", ModifiedAfter: "yesterday"},
+		{Action: "include", Glob: "[a-"},
+	} {
+		_, err := CompileRules([]Rule{{Action: "include", Glob: "*.jpg"}, r})
+		if err == nil || !strings.HasPrefix(err.Error(), "rules[1]: ") {
+			t.Errorf("%+v: error %v", r, err)
+		}
+	}
+}
+
+func TestFindNewPhotosAppliesRules(t *testing.T) {
+	dir := t.TempDir()
+	write := func(rel string, size int) {
+		p := filepath.Join(dir, filepath.FromSlash(rel))
+		os.MkdirAll(filepath.Dir(p), 0755)
+		os.WriteFile(p, []byte(strings.Repeat(rel, size)), 0644)
+	}
+	write("2024/a.jpg", 10)
+	write("2024/tiny.jpg", 1)
+	write("resources/derivatives/a.jpg", 10)
+	write("Screenshots/s.png", 10)
+	write("Screenshots/keep.png", 10)
+	write(".thumbs/t.jpg", 10)
+	write("anim.gif", 10)
+	write("notes.txt", 10)
+	write("old.jpg", 10)
+	old := time.Date(2000, 1, 1, 0, 0, 0, 0, time.Local)
+	os.Chtimes(filepath.Join(dir, "old.jpg"), old, old)
+
+	hidden := true
+	rules, err := CompileRules([]Rule{
+		{Name: "derivatives", Action: "exclude", Glob: "**/resources/derivatives/**"},
+		{Action: "include", Glob: "keep.png"},
+		{Name: "screenshots", Action: "exclude", Regex: `^Screenshots/`},
+		{Name: "thumbnails", Action: "exclude", MaxSize: "20B", Extensions: []string{".jpg"}},
+		{Name: "hidden", Action: "exclude", Hidden: &hidden},
+		{Name: "old", Action: "exclude", ModifiedBefore: "2001-01-01"},
+		{Name: "gifs", Action: "include", Extensions: []string{".GIF"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := scanLibrary(t, dir, ScanOptions{AllowedExtensions: []string{".jpg", ".png"}, Rules: rules})
+	var got []string
+	for _, f := range res.Files {
+		rel, _ := filepath.Rel(dir, f.Path)
+		got = append(got, filepath.ToSlash(rel))
+	}
+	sort.Strings(got)
+	if strings.Join(got, " ") != "2024/a.jpg Screenshots/keep.png anim.gif" {
+		t.Errorf("included %v", got)
+	}
+
+	counts := make(map[string]int)
+	for _, m := range res.Rules {
+		counts[m.Rule] = m.Files
+	}
+	want := map[string]int{
+		"derivatives": 1, "include glob keep.png": 1, "screenshots": 1, "thumbnails": 1, "hidden": 1, "old": 1, "gifs": 1,
+		RuleAllowedExtensions: 1, RuleSidecarExtensions: 0, RuleOtherExtensions: 1,
+	}
+	for rule, n := range want {
+		if counts[rule] != n {
+			t.Errorf("rule %q matched %d files, want %d (all counts %v)", rule, counts[rule], n, counts)
+		}
+	}
+	if excluded := res.Excluded(); excluded[".jpg"] != 4 || excluded[".png"] != 1 || excluded[".txt"] != 1 {
+		t.Errorf("excluded %v", excluded)
+	}
+}
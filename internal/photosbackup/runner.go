@@ -0,0 +1,891 @@
+package photosbackup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RunOptions are the settings of a Runner that are given per run rather than in the config.
+type RunOptions struct {
+	DryRun bool // Scan and report what would be uploaded, without uploading or saving backup state
+	// Limit is the number of new files uploaded per source; 0 means no limit, or
+	// test_mode_limit for runs with a Prefix.
+	Limit int
+	// Prefix is prepended to every key, e.g. "test/". Runs with a prefix keep their own
+	// catalog and upload state, so they never mark files as backed up for normal runs.
+	Prefix string
+	Dir    string    // Directory of local files with relative names (default: the working directory)
+	Out    io.Writer // Progress and summaries (default: os.Stdout)
+}
+
+// Runner runs the backup pipeline, and the commands that work on its archives, for one
+// config. Sources are processed one after another; they share the catalog, so content
+// already backed up from one source is not stored again for another.
+type Runner struct {
+	cfg         *Config
+	opts        RunOptions
+	backend     Backend
+	sources     []Source // with the run's prefix in their KeyPrefix
+	rules       []*RuleSet
+	defaultZone *time.Location
+	bucketZone  *time.Location
+
+	catalog       *Catalog
+	catalogPath   string
+	scanCache     *ScanCache
+	scanCachePath string
+	stateMu       sync.Mutex
+	state         *UploadState
+	statePath     string
+	retryDelay    time.Duration // Wait before the second upload attempt; later ones wait longer
+}
+
+// NewRunner checks cfg and applies its defaults, opens its backend and loads the catalog,
+// scan cache and upload state. The source directories are checked by Backup, so that
+// archives can be restored on a machine without them.
+func NewRunner(ctx context.Context, cfg *Config, opts RunOptions) (*Runner, error) {
+	if err := cfg.validate(false); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	r := &Runner{cfg: cfg, opts: opts, retryDelay: time.Second}
+	if r.opts.Out == nil {
+		r.opts.Out = os.Stdout
+	}
+	if r.opts.Prefix = strings.Trim(opts.Prefix, "/"); r.opts.Prefix != "" {
+		if err := checkKey(r.opts.Prefix); err != nil {
+			return nil, fmt.Errorf("invalid prefix: %w", err)
+		}
+		r.opts.Prefix += "/"
+	}
+	if r.opts.Limit == 0 && r.opts.Prefix != "" {
+		r.opts.Limit = cfg.TestModeLimit
+	}
+	sources, err := cfg.BackupSources()
+	if err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	for _, src := range sources {
+		rules, err := cfg.CompileSourceRules(src)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config: %w", err)
+		}
+		src.KeyPrefix = r.opts.Prefix + src.KeyPrefix
+		r.sources = append(r.sources, src)
+		r.rules = append(r.rules, rules)
+	}
+	if r.defaultZone, err = cfg.DefaultZone(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	if r.bucketZone, err = cfg.BucketZone(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+
+	if r.backend, err = NewBackend(ctx, cfg); err != nil {
+		return nil, fmt.Errorf("open backend: %w", err)
+	}
+	// Dry runs keep what they would record in memory
+	r.catalogPath = r.localPath(r.prefixed(cfg.CatalogFile))
+	if r.catalog, err = OpenCatalog(r.catalogPath, opts.DryRun); err != nil {
+		return nil, fmt.Errorf("open catalog: %w", err)
+	}
+	// The scan cache holds no backup state, so runs with a prefix share it
+	r.scanCachePath = r.localPath(cfg.ScanCacheFile)
+	if r.scanCache, err = LoadScanCache(r.scanCachePath); err != nil {
+		log.Printf("[WARN] Ignoring unreadable scan cache: %v", err)
+		r.scanCache = NewScanCache()
+	}
+	r.statePath = r.localPath(r.prefixed("upload_state.json"))
+	if r.state, err = LoadUploadState(r.statePath); err != nil {
+		r.catalog.Close()
+		return nil, fmt.Errorf("load upload state: %w", err)
+	}
+	return r, nil
+}
+
+// Close closes the catalog.
+func (r *Runner) Close() error { return r.catalog.Close() }
+
+// Sources returns the sources of the run, with the run's prefix in their KeyPrefix.
+func (r *Runner) Sources() []Source { return r.sources }
+
+// Backend returns the storage backend of the run.
+func (r *Runner) Backend() Backend { return r.backend }
+
+// Catalog returns the catalog of the run.
+func (r *Runner) Catalog() *Catalog { return r.catalog }
+
+// State returns the upload state of the run.
+func (r *Runner) State() *UploadState { return r.state }
+
+// localPath resolves name against the run's directory.
+func (r *Runner) localPath(name string) string {
+	if r.opts.Dir == "" || filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(r.opts.Dir, name)
+}
+
+// prefixed returns the name of a state file for the run's prefix: "catalog.db" becomes
+// "catalog_test.db" for the prefix "test/".
+func (r *Runner) prefixed(name string) string {
+	if r.opts.Prefix == "" {
+		return name
+	}
+	ext := filepath.Ext(name)
+	tag := strings.ReplaceAll(strings.Trim(r.opts.Prefix, "/"), "/", "_")
+	return strings.TrimSuffix(name, ext) + "_" + tag + ext
+}
+
+func orDefault(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
+
+// BackupResult summarizes a backup run.
+type BackupResult struct {
+	Sources []SourceResult
+	Failed  int // Archives that could not be uploaded
+}
+
+// SourceResult is the outcome of backing up one source.
+type SourceResult struct {
+	Source   Source
+	Scan     ScanResult
+	Archives []ArchivePlan // One per month with new files, in month order
+}
+
+// ArchivePlan is the archive of a source's new files of one month.
+type ArchivePlan struct {
+	Month    string
+	Key      string
+	Files    []PhotoMeta
+	Bytes    int64
+	Uploaded bool
+}
+
+// Backup scans every source and uploads its new files as monthly archives. With DryRun
+// nothing is uploaded and the catalog and upload state are left unchanged; Plan turns
+// the result into a report of what would be uploaded. It stops
+// with an error if a scan fails; failed uploads are counted in the result.
+func (r *Runner) Backup(ctx context.Context) (*BackupResult, error) {
+	cfg := r.cfg
+	// Files the last-upload-time model backed up are only skipped if Seed recorded them
+	if r.catalog.Len() == 0 && r.opts.Prefix == "" && len(cfg.Sources) == 0 {
+		if lastUpload := GetLastUploadTime(r.localPath(cfg.LastUploadFile)); !lastUpload.IsZero() {
+			fmt.Fprintf(r.opts.Out, "The catalog is empty, so every file is uploaded, including those backed up before %s; use backup -seed-last-upload to record those as backed up instead\n", lastUpload.Format(time.RFC3339))
+		}
+	}
+
+	res := &BackupResult{}
+	for i, src := range r.sources {
+		if len(r.sources) > 1 {
+			fmt.Fprintf(r.opts.Out, "\n=== Source %s: %s ===\n", src.Name, src.Path)
+		}
+		sr, failed, err := r.backupSource(ctx, src, r.rules[i])
+		res.Sources = append(res.Sources, sr)
+		res.Failed += failed
+		if err != nil {
+			return res, fmt.Errorf("scan of %s: %w", src.Label(), err)
+		}
+	}
+
+	if r.opts.DryRun {
+		return res, nil // Plan reports what would be uploaded
+	}
+	// Record when this run finished (informational; new files are found via the catalog)
+	if r.opts.Prefix == "" && cfg.LastUploadFile != "" {
+		UpdateLastUploadTime(r.localPath(cfg.LastUploadFile))
+	}
+	fmt.Fprintf(r.opts.Out, "Upload complete. Failed uploads: %d\n", res.Failed)
+	return res, nil
+}
+
+// Seed records the files of photos_library_path that the last-upload-time model backed
+// up before last_upload_file as backed up (see SeedCatalog), so a first run with the
+// catalog does not upload them again. Nothing checks that the archives of that model
+// hold them; verify and prune report them as unconfirmed. It only seeds an empty
+// catalog, and never configured sources, which that model did not back up.
+func (r *Runner) Seed(ctx context.Context) (int, error) {
+	switch {
+	case r.opts.Prefix != "":
+		return 0, errors.New("runs with a prefix keep their own catalog, which is never seeded")
+	case len(r.cfg.Sources) > 0:
+		return 0, errors.New("only photos_library_path can be seeded; sources were never backed up by last_upload_file")
+	case r.catalog.Len() > 0:
+		return 0, fmt.Errorf("the catalog %s already records %d files", r.catalogPath, r.catalog.Len())
+	}
+	lastUpload := GetLastUploadTime(r.localPath(r.cfg.LastUploadFile))
+	if lastUpload.IsZero() {
+		return 0, errors.New("last_upload_file records no upload time")
+	}
+	src := r.sources[0]
+	if err := checkSourcePath(src); err != nil {
+		return 0, err
+	}
+	scan, err := r.scanSource(ctx, src, r.rules[0])
+	if err != nil {
+		return 0, fmt.Errorf("scan of %s: %w", src.Label(), err)
+	}
+	n, err := SeedCatalog(r.catalog, scan, lastUpload)
+	if err != nil {
+		return 0, fmt.Errorf("seed catalog: %w", err)
+	}
+	fmt.Fprintf(r.opts.Out, "Seeded catalog with %d of %d files of %s backed up before %s; they stay unconfirmed as no archive is known to hold them\n",
+		n, len(scan.Files), src.Label(), lastUpload.Format(time.RFC3339))
+	return n, nil
+}
+
+// backupSource scans src and uploads its new files. It returns the number of archives
+// that failed to upload.
+func (r *Runner) backupSource(ctx context.Context, src Source, rules *RuleSet) (SourceResult, int, error) {
+	out := r.opts.Out
+	sr := SourceResult{Source: src}
+	if err := checkSourcePath(src); err != nil {
+		return sr, 0, err
+	}
+	hitsBefore := r.scanCache.Hits()
+	scan, err := r.scanSource(ctx, src, rules)
+	if err != nil {
+		return sr, 0, err
+	}
+	sr.Scan = scan
+	r.printScanSummary(scan, r.scanCache.Hits()-hitsBefore)
+
+	newFiles := scan.Files
+	if limit := r.opts.Limit; limit > 0 && len(newFiles) > limit {
+		newFiles = limitFiles(newFiles, limit)
+		fmt.Fprintf(out, "Limiting this run to the first %d new files\n", len(newFiles))
+	}
+	if len(newFiles) == 0 {
+		return sr, 0, nil
+	}
+
+	// Plan one archive per month; the timestamp keeps later archives of a month apart
+	timestamp := time.Now().Format("20060102T150405")
+	for ym, files := range GroupPhotosByYearMonth(newFiles, r.bucketZone) {
+		plan := ArchivePlan{Month: ym, Files: files}
+		if plan.Key, err = src.ArchiveKey(r.cfg, fmt.Sprintf("%s_%s.zip", ym, timestamp), archiveCamera(files)); err != nil {
+			return sr, 0, err
+		}
+		for _, f := range files {
+			plan.Bytes += f.Size
+		}
+		sr.Archives = append(sr.Archives, plan)
+	}
+	sort.Slice(sr.Archives, func(i, j int) bool { return sr.Archives[i].Month < sr.Archives[j].Month })
+
+	if r.opts.DryRun {
+		return sr, 0, nil
+	}
+
+	// Log the metadata read during the scan
+	for _, meta := range newFiles {
+		LogPhotoMeta(meta)
+	}
+	r.uploadMetadata(ctx, src, newFiles)
+	failed := r.uploadArchives(ctx, src, scan.Duplicates, sr.Archives)
+	return sr, failed, nil
+}
+
+// scanSource finds the files of src that are not yet in the catalog, with albums,
+// favorites, keywords and people from its Photos library if one is configured.
+func (r *Runner) scanSource(ctx context.Context, src Source, rules *RuleSet) (ScanResult, error) {
+	var library *PhotosLibrary
+	if dbPath := src.PhotosDatabasePath(); dbPath != "" {
+		var err error
+		if library, err = LoadPhotosLibrary(dbPath); err != nil {
+			return ScanResult{}, fmt.Errorf("read Photos library database: %w", err)
+		}
+		fmt.Fprintf(r.opts.Out, "Read %d assets from %s\n", library.Len(), dbPath)
+	} else if *src.ExcludeTrashed {
+		log.Printf("[WARN] exclude_trashed has no effect without photos_database")
+	}
+	scan, err := FindNewPhotos(ctx, src.Path, ScanOptions{
+		AllowedExtensions: src.AllowedExtensions,
+		Rules:             rules,
+		Catalog:           r.catalog,
+		Cache:             r.scanCache,
+		Workers:           r.cfg.ScanWorkers,
+		DefaultZone:       r.defaultZone,
+		SidecarExtensions: src.SidecarExtensions,
+		Library:           library,
+		ExcludeTrashed:    *src.ExcludeTrashed,
+		SniffContent:      *src.SniffContent,
+	})
+	if err := SaveScanCache(r.scanCachePath, r.scanCache); err != nil {
+		log.Printf("[ERROR] Failed to save scan cache: %v", err)
+	}
+	return scan, err
+}
+
+// uploadAttempts is how often an archive is uploaded before it counts as failed.
+const uploadAttempts = 3
+
+// sleepContext waits for d and reports whether it did, or returns false as soon as ctx
+// is done.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// limitFiles returns the first limit of files, and with them the sidecars and the other
+// component of Live Photos among them, so that a limited run splits neither.
+func limitFiles(files []PhotoMeta, limit int) []PhotoMeta {
+	keep := make([]bool, len(files))
+	partner := make(map[int]int)
+	for video, still := range pairLivePhotos(files) {
+		partner[video], partner[still] = still, video
+	}
+	for i := 0; i < limit && i < len(files); i++ {
+		keep[i] = true
+		if p, ok := partner[i]; ok {
+			keep[p] = true
+		}
+	}
+	// Sidecars follow their photo
+	kept := make(map[string]bool)
+	var out []PhotoMeta
+	for i, f := range files {
+		if keep[i] || (f.Primary != "" && kept[f.Primary]) {
+			out = append(out, f)
+			kept[f.Path] = true
+		}
+	}
+	return out
+}
+
+// printScanSummary prints the statistics of a scan, how many files each rule included or
+// excluded (they are not individually logged), and files whose content and extension
+// disagree.
+func (r *Runner) printScanSummary(scan ScanResult, cacheHits int) {
+	out := r.opts.Out
+	st := scan.Stats
+	fmt.Fprintf(out, "Scanned %d files in %s with %d workers (%.0f files/s, %.1f MiB/s hashed)\n",
+		st.Files, st.Duration.Round(time.Millisecond), st.Workers, st.FilesPerSecond(), st.MiBPerSecond())
+	if cacheHits > 0 {
+		fmt.Fprintf(out, "Reused cached metadata for %d files\n", cacheHits)
+	}
+	if scan.Trashed > 0 {
+		fmt.Fprintf(out, "Skipped %d files in Recently Deleted\n", scan.Trashed)
+	}
+	if scan.Orphans > 0 {
+		fmt.Fprintf(out, "Backing up %d sidecars without a matching photo on their own\n", scan.Orphans)
+	}
+	if scan.Known > 0 {
+		fmt.Fprintf(out, "Skipped %d files whose content is already backed up under another path\n", scan.Known)
+	}
+	if len(scan.Files) == 0 {
+		fmt.Fprintln(out, "No new photos to upload.")
+	}
+
+	fmt.Fprintln(out, "Rule summary:")
+	for _, m := range scan.Rules {
+		if m.Files == 0 {
+			continue
+		}
+		action := "included"
+		if m.Exclude {
+			action = "excluded"
+		}
+		fmt.Fprintf(out, "  %s: %d %s\n", m.Rule, m.Files, action)
+		if m.Exclude {
+			for ext, count := range m.ByExt {
+				fmt.Fprintf(out, "    %s: %d\n", ext, count)
+			}
+		}
+	}
+
+	if len(scan.Mismatches) > 0 {
+		fmt.Fprintf(out, "Extension/content mismatches: %d\n", len(scan.Mismatches))
+		for i, m := range scan.Mismatches {
+			if i == 20 {
+				fmt.Fprintf(out, "  ... and %d more\n", len(scan.Mismatches)-i)
+				break
+			}
+			detected, action := "not a recognized photo or video", "excluded"
+			if m.Detected != "" {
+				detected = "looks like " + m.Detected
+			}
+			if m.Included {
+				action = "included"
+			}
+			fmt.Fprintf(out, "  %s: %s (%s)\n", m.Path, detected, action)
+		}
+	}
+}
+
+// uploadMetadata saves the metadata of files to photo_metadata.json and uploads it next
+// to the source's archives.
+func (r *Runner) uploadMetadata(ctx context.Context, src Source, files []PhotoMeta) {
+	metaPath := r.localPath("photo_metadata.json")
+	metaFile, err := os.Create(metaPath)
+	if err != nil {
+		log.Printf("[ERROR] Could not create photo_metadata.json: %v", err)
+		return
+	}
+	enc := json.NewEncoder(metaFile)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(files); err != nil {
+		log.Printf("[ERROR] Could not write photo_metadata.json: %v", err)
+	}
+	metaFile.Close()
+	metaKey := src.KeyPrefix + "photo_metadata.json"
+	if err := UploadFile(ctx, r.backend, metaKey, metaPath, r.cfg.StorageClass); err != nil {
+		log.Printf("[ERROR] Failed to upload photo_metadata.json: %v", err)
+	} else {
+		fmt.Fprintf(r.opts.Out, "[DONE] Uploaded %s\n", metaKey)
+	}
+}
+
+// uploadArchives streams the planned archives to the backend, at most
+// max_concurrent_uploads at a time, and records each uploaded one in the catalog and
+// the upload state. It returns the number of archives that failed.
+func (r *Runner) uploadArchives(ctx context.Context, src Source, duplicates map[string][]string, plans []ArchivePlan) int {
+	cfg, out := r.cfg, r.opts.Out
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	failedUploads := 0
+
+	// Set up progress bar variables
+	barWidth := 40
+	totalFiles := 0
+	for _, p := range plans {
+		totalFiles += len(p.Files)
+	}
+	fileProgress := 0
+	progressMu := sync.Mutex{}
+	// Function to update the progress bar in the console
+	updateBar := func(label string) {
+		percent := float64(fileProgress) / float64(totalFiles)
+		filled := int(percent * float64(barWidth))
+		bar := strings.Repeat("\033[42m \033[0m", filled) + strings.Repeat(" ", barWidth-filled)
+		fmt.Fprintf(out, "\r%s [%s] %3d%% (%d/%d)", label, bar, int(percent*100), fileProgress, totalFiles)
+		if fileProgress == totalFiles {
+			fmt.Fprintln(out)
+		}
+	}
+
+	// Set up a semaphore to limit concurrency
+	sem := make(chan struct{}, cfg.MaxConcurrentUploads)
+
+	for i := range plans {
+		wg.Add(1)
+		go func(plan *ArchivePlan) {
+			defer wg.Done()
+			sem <- struct{}{}        // acquire
+			defer func() { <-sem }() // release
+			zipName := filepath.Base(plan.Key)
+			label := zipName // label for progress bar
+			fmt.Fprintf(out, "\n[START] Streaming %d files as %s to %s\n", len(plan.Files), zipName, plan.Key)
+			// Zip and upload in one pass, retrying the whole stream on failure. Large months
+			// get larger parts, as S3 allows at most 10,000 of them
+			putOpts := PutOptions{
+				StorageClass: cfg.StorageClass,
+				PartSize:     ArchivePartSize(plan.Bytes, int64(cfg.UploadPartSizeMB)<<20),
+			}
+			var manifest *Manifest
+			var uploadErr error
+			attempt := 1
+			for ; ; attempt++ {
+				var localSum ArchiveChecksum
+				localSum, manifest, uploadErr = UploadZip(ctx, r.backend, plan.Key, plan.Files, duplicates, putOpts)
+				if uploadErr == nil {
+					// Verify the checksum the backend recorded against the one computed while
+					// streaming; a damaged archive is deleted and uploaded again
+					if uploadErr = VerifyUpload(ctx, r.backend, plan.Key, localSum); uploadErr == nil {
+						fmt.Fprintf(out, "[OK] Checksum verified for %s\n", zipName)
+						break
+					}
+					uploadErr = fmt.Errorf("checksum verification: %w", uploadErr)
+					if err := r.backend.Delete(ctx, plan.Key); err != nil {
+						log.Printf("[ERROR] Failed to delete %s after its checksum did not match: %v", plan.Key, err)
+					}
+				}
+				log.Printf("[WARN] Upload attempt %d for %s failed: %v", attempt, zipName, uploadErr)
+				// Back off between attempts, unless the run is cancelled
+				if attempt == uploadAttempts || !sleepContext(ctx, r.retryDelay*time.Duration(attempt)) {
+					break
+				}
+			}
+			if uploadErr != nil {
+				log.Printf("[ERROR] Failed to upload %s after %d attempts: %v", zipName, attempt, uploadErr)
+				mu.Lock()
+				failedUploads++
+				mu.Unlock()
+				return
+			}
+			// Update progress bar for each file
+			for i, file := range plan.Files {
+				progressMu.Lock()
+				fileProgress++
+				updateBar(label + fmt.Sprintf(" file %d/%d: %s", i+1, len(plan.Files), file.Path))
+				progressMu.Unlock()
+			}
+			// Store the manifest next to the archive so its contents can be found without downloading it
+			if err := UploadManifest(ctx, r.backend, plan.Key, manifest); err != nil {
+				log.Printf("[ERROR] Failed to upload manifest for %s: %v", zipName, err)
+			}
+			// Record the archived files in the catalog so later runs skip them
+			if err := r.catalog.AddManifest(manifest, plan.Key, cfg.StorageClass, time.Now()); err != nil {
+				log.Printf("[ERROR] Failed to record %s in the catalog: %v", plan.Key, err)
+			}
+			// Record this month's latest archive in the source's upload state
+			r.stateMu.Lock()
+			r.state.Record(src.State, plan.Month, plan.Key)
+			if err := SaveUploadState(r.statePath, r.state); err != nil {
+				log.Printf("[ERROR] Failed to save upload state: %v", err)
+			}
+			r.stateMu.Unlock()
+			plan.Uploaded = true
+			fmt.Fprintf(out, "[DONE] Uploaded %s\n", plan.Key)
+			progressMu.Lock()
+			updateBar(label + " uploaded!")
+			progressMu.Unlock()
+		}(&plans[i])
+	}
+	wg.Wait()
+	return failedUploads
+}
+
+// selectSources returns the sources of the run called name, or all of them for "".
+func (r *Runner) selectSources(name string) ([]Source, error) {
+	if name == "" {
+		return r.sources, nil
+	}
+	for _, src := range r.sources {
+		if src.Name == name {
+			return []Source{src}, nil
+		}
+	}
+	return nil, fmt.Errorf("no source named %q", name)
+}
+
+// RestoreOptions selects the archives a restore extracts.
+type RestoreOptions struct {
+	From, To  string // Year-months (YYYY-MM), inclusive; empty bounds are open
+	Dest      string // Directory to extract into; with several sources each gets a subdirectory
+	Source    string // Restore only this source
+	StateFile string // Restore the archives recorded in this upload state instead of listing the backend
+}
+
+// Restore extracts the selected archives. It returns the number of archives that failed.
+// With DryRun it only prints which archives would be restored.
+func (r *Runner) Restore(ctx context.Context, opts RestoreOptions) (RestoreStats, int, error) {
+	var stats RestoreStats
+	sources, err := r.selectSources(opts.Source)
+	if err != nil {
+		return stats, 0, err
+	}
+	var state *UploadState
+	if opts.StateFile != "" {
+		if state, err = LoadUploadState(opts.StateFile); err != nil {
+			return stats, 0, fmt.Errorf("load upload state: %w", err)
+		}
+	}
+	failed := 0
+	for _, src := range sources {
+		// Pick the archives to restore, either from the upload state or by listing the backend
+		var keys []string
+		if state != nil {
+			keys = StateArchiveKeys(r.cfg, src, state, opts.From, opts.To)
+		} else {
+			archives, err := SourceArchives(ctx, r.backend, r.cfg, src, opts.From, opts.To)
+			if err != nil {
+				return stats, failed, fmt.Errorf("list archives of %s: %w", src.Label(), err)
+			}
+			for _, a := range archives {
+				keys = append(keys, a.Key)
+			}
+		}
+		if len(keys) == 0 {
+			fmt.Fprintf(r.opts.Out, "No archives of %s match the requested range.\n", src.Label())
+			continue
+		}
+		// Keep the files of several sources apart
+		dest := opts.Dest
+		if len(sources) > 1 {
+			dest = filepath.Join(dest, src.Name)
+		}
+		for _, key := range keys {
+			if r.opts.DryRun {
+				fmt.Fprintf(r.opts.Out, "[DRY RUN] Would restore %s into %s\n", key, dest)
+				continue
+			}
+			fmt.Fprintf(r.opts.Out, "[START] Restoring %s\n", key)
+			aliases, err := r.catalog.ArchiveAliases(key)
+			if err != nil {
+				log.Printf("[WARN] Restoring %s without the copies the catalog records: %v", key, err)
+			}
+			if err := RestoreArchive(ctx, r.backend, key, dest, src.Path, aliases, &stats); err != nil {
+				log.Printf("[ERROR] Failed to restore %s: %v", key, err)
+				failed++
+				continue
+			}
+			fmt.Fprintf(r.opts.Out, "[DONE] Restored %s\n", key)
+		}
+	}
+	return stats, failed, nil
+}
+
+// SourceArchiveList is the archives of one source.
+type SourceArchiveList struct {
+	Source   Source
+	Archives []ObjectInfo
+}
+
+// ListArchives lists the archives of the source called name (all sources for "") whose
+// year-month lies within [from, to].
+func (r *Runner) ListArchives(ctx context.Context, name, from, to string) ([]SourceArchiveList, error) {
+	sources, err := r.selectSources(name)
+	if err != nil {
+		return nil, err
+	}
+	var lists []SourceArchiveList
+	for _, src := range sources {
+		archives, err := SourceArchives(ctx, r.backend, r.cfg, src, from, to)
+		if err != nil {
+			return nil, fmt.Errorf("list archives of %s: %w", src.Label(), err)
+		}
+		lists = append(lists, SourceArchiveList{Source: src, Archives: archives})
+	}
+	return lists, nil
+}
+
+// VerifyResult summarizes a verify run.
+type VerifyResult struct {
+	Archives int // Archives checked
+	Files    int // Files in the downloaded archives
+	Failed   int // Archives that are missing, damaged or lack a manifest
+	// Unconfirmed is the number of seeded files of the selected sources, which the
+	// catalog records as backed up without an archive
+	Unconfirmed int
+}
+
+// Verify checks that every archive the catalog refers to exists, and that every archive
+// of the selected sources has its manifest. With download, archives are also downloaded
+// and checked against their checksum, member CRCs and manifest.
+func (r *Runner) Verify(ctx context.Context, name, from, to string, download bool) (VerifyResult, error) {
+	var res VerifyResult
+	lists, err := r.ListArchives(ctx, name, from, to)
+	if err != nil {
+		return res, err
+	}
+	stored := make(map[string]bool)
+	for _, l := range lists {
+		for _, a := range l.Archives {
+			stored[a.Key] = true
+		}
+	}
+	// Archives the catalog refers to must exist
+	referenced := make(map[string]int)
+	err = r.catalog.ForEach(func(e *CatalogEntry) error {
+		if e.Seeded() {
+			for _, l := range lists {
+				if rel, err := filepath.Rel(l.Source.Path, e.SourcePath); err == nil && !strings.HasPrefix(rel, "..") {
+					res.Unconfirmed++
+					break
+				}
+			}
+			return nil
+		}
+		for _, l := range lists {
+			if ym, ok := ArchiveYearMonth(e.Key); ok && inMonthRange(ym, from, to) && l.Source.ownsArchive(r.cfg, e.Key) {
+				referenced[e.Key]++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return res, fmt.Errorf("read catalog: %w", err)
+	}
+	var missing []string
+	for key := range referenced {
+		if !stored[key] {
+			missing = append(missing, key)
+		}
+	}
+	sort.Strings(missing)
+	for _, key := range missing {
+		fmt.Fprintf(r.opts.Out, "[ERROR] %s is missing; the catalog has %d files in it\n", key, referenced[key])
+		res.Failed++
+	}
+	if res.Unconfirmed > 0 {
+		fmt.Fprintf(r.opts.Out, "[WARN] %d files were seeded from last_upload_file and are not confirmed to be in any archive\n", res.Unconfirmed)
+	}
+
+	for _, l := range lists {
+		for _, a := range l.Archives {
+			res.Archives++
+			if _, err := FetchManifest(ctx, r.backend, a.Key); err != nil {
+				fmt.Fprintf(r.opts.Out, "[ERROR] %s: manifest: %v\n", a.Key, err)
+				res.Failed++
+				continue
+			}
+			if !download {
+				fmt.Fprintf(r.opts.Out, "[OK] %s\n", a.Key)
+				continue
+			}
+			n, err := VerifyArchive(ctx, r.backend, a.Key)
+			if err != nil {
+				fmt.Fprintf(r.opts.Out, "[ERROR] %v\n", err)
+				res.Failed++
+				continue
+			}
+			res.Files += n
+			fmt.Fprintf(r.opts.Out, "[OK] %s: %d files\n", a.Key, n)
+		}
+	}
+	return res, nil
+}
+
+// Status prints the sources, the months recorded in the upload state, and the size of
+// the catalog and scan cache.
+func (r *Runner) Status() {
+	out := r.opts.Out
+	for _, src := range r.sources {
+		months := r.state.Months(src.State)
+		fmt.Fprintf(out, "Source %s\n  path: %s\n", src.Label(), src.Path)
+		if src.KeyPrefix != "" {
+			fmt.Fprintf(out, "  key prefix: %s\n", src.KeyPrefix)
+		}
+		if len(months) == 0 {
+			fmt.Fprintln(out, "  no archives recorded")
+			continue
+		}
+		latest := ""
+		for ym := range months {
+			if ym > latest {
+				latest = ym
+			}
+		}
+		fmt.Fprintf(out, "  %d months recorded, latest %s (%s)\n", len(months), latest, months[latest])
+	}
+
+	archives := make(map[string]bool)
+	var size int64
+	unconfirmed := 0
+	if err := r.catalog.ForEach(func(e *CatalogEntry) error {
+		size += e.Size
+		if e.Seeded() {
+			unconfirmed++
+		} else {
+			archives[e.Key] = true
+		}
+		return nil
+	}); err != nil {
+		log.Printf("[ERROR] Failed to read catalog: %v", err)
+	}
+	fmt.Fprintf(out, "Catalog %s: %d files (%.1f GiB) in %d archives\n", r.catalogPath, r.catalog.Len(), float64(size)/(1<<30), len(archives))
+	if unconfirmed > 0 {
+		fmt.Fprintf(out, "  %d files seeded from last_upload_file, not confirmed to be in any archive\n", unconfirmed)
+	}
+	if last := GetLastUploadTime(r.localPath(r.cfg.LastUploadFile)); !last.IsZero() {
+		fmt.Fprintf(out, "Last run finished %s\n", last.Format(time.RFC3339))
+	} else {
+		fmt.Fprintln(out, "No finished run recorded")
+	}
+	fmt.Fprintf(out, "Scan cache %s: %d files\n", r.scanCachePath, len(r.scanCache.Entries))
+}
+
+// PruneResult summarizes a prune run.
+type PruneResult struct {
+	Archives int   // Archives no longer referenced
+	Bytes    int64 // Their size
+	Deleted  int   // Archives deleted
+	Kept     int   // Unreferenced archives kept because they predate the catalog
+	// Unconfirmed is the number of seeded files, which the catalog records as backed up
+	// without an archive
+	Unconfirmed int
+}
+
+// Prune finds archives of the selected sources that neither the catalog nor the upload
+// state refers to, such as leftovers of runs whose catalog could not be saved, and with
+// apply (and without DryRun) deletes them together with their manifests.
+//
+// Files recorded by Seed have no archive location, and states written before
+// their history was kept only name the latest archive of each month. So if the catalog
+// was seeded, archives older than its first upload may hold the only copy of seeded
+// files; they are kept.
+func (r *Runner) Prune(ctx context.Context, name string, apply bool) (PruneResult, error) {
+	var res PruneResult
+	if r.catalog.Len() == 0 {
+		return res, fmt.Errorf("the catalog %s is empty, so every archive would be pruned", r.catalogPath)
+	}
+	lists, err := r.ListArchives(ctx, name, "", "")
+	if err != nil {
+		return res, err
+	}
+	referenced := make(map[string]bool)
+	var firstUpload time.Time
+	err = r.catalog.ForEach(func(e *CatalogEntry) error {
+		if e.Seeded() {
+			res.Unconfirmed++
+			return nil
+		}
+		referenced[e.Key] = true
+		if firstUpload.IsZero() || e.Uploaded.Before(firstUpload) {
+			firstUpload = e.Uploaded
+		}
+		return nil
+	})
+	if err != nil {
+		return res, fmt.Errorf("read catalog: %w", err)
+	}
+	if res.Unconfirmed > 0 {
+		fmt.Fprintf(r.opts.Out, "[WARN] %d files were seeded from last_upload_file and are not confirmed to be in any archive\n", res.Unconfirmed)
+	}
+	for _, l := range lists {
+		for _, key := range StateArchiveKeys(r.cfg, l.Source, r.state, "", "") {
+			referenced[key] = true
+		}
+		for _, a := range l.Archives {
+			if referenced[a.Key] {
+				continue
+			}
+			res.Archives++
+			res.Bytes += a.Size
+			if res.Unconfirmed > 0 {
+				if run, ok := ArchiveRunTime(a.Key); !ok || firstUpload.IsZero() || run.Before(firstUpload) {
+					res.Kept++
+					fmt.Fprintf(r.opts.Out, "[KEEP] %s predates the catalog and may hold files it was seeded with\n", a.Key)
+					continue
+				}
+			}
+			if !apply || r.opts.DryRun {
+				fmt.Fprintf(r.opts.Out, "[DRY RUN] Would delete %s (%.1f MiB)\n", a.Key, float64(a.Size)/(1<<20))
+				continue
+			}
+			if err := r.backend.Delete(ctx, a.Key); err != nil {
+				log.Printf("[ERROR] Failed to delete %s: %v", a.Key, err)
+				continue
+			}
+			if err := r.backend.Delete(ctx, ManifestKey(a.Key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				log.Printf("[ERROR] Failed to delete the manifest of %s: %v", a.Key, err)
+			}
+			res.Deleted++
+			fmt.Fprintf(r.opts.Out, "[DONE] Deleted %s\n", a.Key)
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,311 @@
+package photosbackup
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestRunner returns a Runner for a library holding two photos of different months,
+// backed up to a local directory. Local state files are kept in a temporary directory.
+func newTestRunner(t *testing.T, opts RunOptions) (*Runner, *Config) {
+	t.Helper()
+	dir := t.TempDir()
+	lib := filepath.Join(dir, "library")
+	os.Mkdir(lib, 0755)
+	for _, name := range []string{"rich.jpg", "gps_time.jpg"} {
+		data, _ := os.ReadFile("testdata/" + name)
+		os.WriteFile(filepath.Join(lib, name), data, 0644)
+	}
+	cfg := &Config{
+		PhotosLibrary:     lib,
+		AllowedExtensions: []string{".jpg"},
+		Backend:           BackendConfig{Type: "local", Path: filepath.Join(dir, "store")},
+	}
+	opts.Dir, opts.Out = dir, io.Discard
+	r, err := NewRunner(context.Background(), cfg, opts)
+	if err != nil {
+		t.Fatalf("NewRunner: %v", err)
+	}
+	t.Cleanup(func() { r.Close() })
+	return r, cfg
+}
+
+func TestRunnerBackup(t *testing.T) {
+	ctx := context.Background()
+	r, cfg := newTestRunner(t, RunOptions{})
+	res, err := r.Backup(ctx)
+	if err != nil || res.Failed != 0 {
+		t.Fatalf("Backup: %+v, %v", res, err)
+	}
+	if len(res.Sources) != 1 || len(res.Sources[0].Archives) != 2 || !res.Sources[0].Archives[0].Uploaded {
+		t.Fatalf("unexpected result %+v", res.Sources)
+	}
+	if a := res.Sources[0].Archives[0]; a.Month != "2022-12" || !strings.HasPrefix(a.Key, "2022/2022-12_") {
+		t.Errorf("first archive %s %s", a.Month, a.Key)
+	}
+	if len(r.State().CompletedMonths) != 2 || r.Catalog().Len() != 2 {
+		t.Errorf("state %v, catalog %d entries", r.State().CompletedMonths, r.Catalog().Len())
+	}
+
+	// A new runner reads the saved catalog and finds nothing new
+	r.Close()
+	r2, err := NewRunner(ctx, cfg, RunOptions{Dir: r.opts.Dir, Out: &bytes.Buffer{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r2.Close()
+	if res, err := r2.Backup(ctx); err != nil || len(res.Sources[0].Archives) != 0 {
+		t.Errorf("second backup: %+v, %v", res, err)
+	}
+	if v, err := r2.Verify(ctx, "", "", "", true); err != nil || v.Archives != 2 || v.Files != 2 || v.Failed != 0 {
+		t.Errorf("Verify: %+v, %v", v, err)
+	}
+}
+
+func TestRunnerDryRunLeavesStateAlone(t *testing.T) {
+	r, _ := newTestRunner(t, RunOptions{DryRun: true})
+	res, err := r.Backup(context.Background())
+	if err != nil || len(res.Sources[0].Archives) != 2 {
+		t.Fatalf("Backup: %+v, %v", res, err)
+	}
+	if plan := r.Plan(res); plan.Files != 2 || plan.Archives != 2 || len(plan.Sources[0].Skipped) != 0 {
+		t.Errorf("plan %+v", plan)
+	}
+	for _, name := range []string{"catalog.db", "upload_state.json", "photo_metadata.json"} {
+		if _, err := os.Stat(filepath.Join(r.opts.Dir, name)); err == nil {
+			t.Errorf("dry run wrote %s", name)
+		}
+	}
+	if objects, _ := r.Backend().List(context.Background(), ""); len(objects) != 0 {
+		t.Errorf("dry run uploaded %v", objects)
+	}
+}
+
+func TestRunnerPrefixKeepsItsOwnState(t *testing.T) {
+	r, _ := newTestRunner(t, RunOptions{Prefix: "test", Limit: 1})
+	res, err := r.Backup(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a := res.Sources[0].Archives; len(a) != 1 || len(a[0].Files) != 1 || !strings.HasPrefix(a[0].Key, "test/") {
+		t.Errorf("archives %+v", a)
+	}
+	for name, want := range map[string]bool{"catalog_test.db": true, "upload_state_test.json": true, "catalog.db": false, "upload_state.json": false} {
+		if _, err := os.Stat(filepath.Join(r.opts.Dir, name)); (err == nil) != want {
+			t.Errorf("%s exists: %v, want %v", name, err == nil, want)
+		}
+	}
+	if _, err := NewRunner(context.Background(), r.cfg, RunOptions{Prefix: "test#1/", Dir: r.opts.Dir}); err == nil {
+		t.Error("NewRunner accepted a prefix that is not usable in keys")
+	}
+}
+
+func TestRunnerPruneAndVerify(t *testing.T) {
+	ctx := context.Background()
+	r, _ := newTestRunner(t, RunOptions{})
+	if _, err := r.Backup(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// A leftover of a run whose catalog was lost, and one of a test run
+	stray := "2021/2021-01_20210201T120000.zip"
+	for _, key := range []string{stray, "test/2021/2021-01_20210201T120000.zip"} {
+		r.Backend().Put(ctx, key, strings.NewReader("zip"), PutOptions{})
+	}
+	res, err := r.Prune(ctx, "", false)
+	if err != nil || res.Archives != 1 || res.Deleted != 0 {
+		t.Fatalf("Prune without apply: %+v, %v", res, err)
+	}
+	if res, err = r.Prune(ctx, "", true); err != nil || res.Deleted != 1 {
+		t.Fatalf("Prune: %+v, %v", res, err)
+	}
+	if _, err := r.Backend().Head(ctx, stray); err == nil {
+		t.Errorf("%s not deleted", stray)
+	}
+	if _, err := r.Backend().Head(ctx, "test/2021/2021-01_20210201T120000.zip"); err != nil {
+		t.Errorf("test archive deleted: %v", err)
+	}
+
+	// Deleting an archive the catalog refers to is reported
+	var key string
+	r.Catalog().ForEach(func(e *CatalogEntry) error {
+		key = e.Key
+		return nil
+	})
+	r.Backend().Delete(ctx, key)
+	if v, err := r.Verify(ctx, "", "", "", false); err != nil || v.Failed != 1 || v.Archives != 1 {
+		t.Errorf("Verify after deleting %s: %+v, %v", key, v, err)
+	}
+}
+
+func TestRunnerPruneKeepsArchivesOfSeededFiles(t *testing.T) {
+	ctx := context.Background()
+	r, cfg := newTestRunner(t, RunOptions{})
+	// Both photos were backed up by the last-upload-time model, December's into legacy
+	legacy := "2022/2022-12_20221210T000000.zip"
+	r.Backend().Put(ctx, legacy, strings.NewReader("zip"), PutOptions{})
+	r.State().CompletedMonths["2022-12"] = legacy
+	cfg.LastUploadFile = "last_upload.txt"
+	os.WriteFile(filepath.Join(r.opts.Dir, cfg.LastUploadFile), []byte(time.Now().Add(time.Hour).Format(time.RFC3339)), 0644)
+	if n, err := r.Seed(ctx); err != nil || n != 2 {
+		t.Fatalf("Seed: %d, %v", n, err)
+	}
+	if res, err := r.Backup(ctx); err != nil || len(res.Sources[0].Archives) != 0 || r.Catalog().Len() != 2 {
+		t.Fatalf("backup after seeding: %+v, %v", res, err)
+	}
+	if v, err := r.Verify(ctx, "", "", "", false); err != nil || v.Unconfirmed != 2 {
+		t.Errorf("Verify: %+v, %v", v, err)
+	}
+
+	// A new photo of December gets a newer archive of the month
+	data, _ := os.ReadFile("testdata/rich.jpg")
+	os.WriteFile(filepath.Join(cfg.PhotosLibrary, "rich_copy.jpg"), append(data, 0), 0644)
+	res, err := r.Backup(ctx)
+	if err != nil || len(res.Sources[0].Archives) != 1 || r.State().CompletedMonths["2022-12"] == legacy {
+		t.Fatalf("second backup: %+v, %v", res, err)
+	}
+	if res, err := r.Prune(ctx, "", true); err != nil || res.Archives != 0 || res.Unconfirmed != 2 {
+		t.Errorf("Prune: %+v, %v", res, err)
+	}
+
+	// Without the month's history, the legacy archive predates the catalog
+	r.State().History = nil
+	if res, err := r.Prune(ctx, "", true); err != nil || res.Archives != 1 || res.Kept != 1 || res.Deleted != 0 {
+		t.Errorf("Prune without history: %+v, %v", res, err)
+	}
+	if _, err := r.Backend().Head(ctx, legacy); err != nil {
+		t.Errorf("%s deleted: %v", legacy, err)
+	}
+}
+
+func TestRunnerSeedsOnlyTheLegacyLibrary(t *testing.T) {
+	ctx := context.Background()
+	r, cfg := newTestRunner(t, RunOptions{})
+	r.Close()
+	// The library was backed up by the last-upload-time model; the camera folder is new
+	camera := filepath.Join(r.opts.Dir, "camera")
+	os.Mkdir(camera, 0755)
+	data, _ := os.ReadFile("testdata/rich.jpg")
+	os.WriteFile(filepath.Join(camera, "IMG_0001.jpg"), append(data, 0), 0644)
+	cfg.Sources = []Source{{Name: "library", Path: cfg.PhotosLibrary}, {Name: "camera", Path: camera, KeyPrefix: "camera"}}
+	cfg.PhotosLibrary = ""
+	cfg.LastUploadFile = "last_upload.txt"
+	os.WriteFile(filepath.Join(r.opts.Dir, cfg.LastUploadFile), []byte(time.Now().Add(time.Hour).Format(time.RFC3339)), 0644)
+
+	r, err := NewRunner(ctx, cfg, RunOptions{Dir: r.opts.Dir, Out: io.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err := r.Seed(ctx); err == nil {
+		t.Error("Seed of configured sources succeeded")
+	}
+	res, err := r.Backup(ctx)
+	if err != nil || res.Failed != 0 || len(res.Sources) != 2 {
+		t.Fatalf("Backup: %+v, %v", res, err)
+	}
+	if n := len(res.Sources[1].Archives); n != 1 {
+		t.Errorf("camera source uploaded %d archives, want 1", n)
+	}
+	r.Catalog().ForEach(func(e *CatalogEntry) error {
+		if e.Key == "" {
+			t.Errorf("%s recorded as backed up without an archive", e.SourcePath)
+		}
+		return nil
+	})
+}
+
+func TestRunnerBackupSeedsOnlyWhenAsked(t *testing.T) {
+	r, cfg := newTestRunner(t, RunOptions{})
+	cfg.LastUploadFile = "last_upload.txt"
+	os.WriteFile(filepath.Join(r.opts.Dir, cfg.LastUploadFile), []byte(time.Now().Add(time.Hour).Format(time.RFC3339)), 0644)
+	res, err := r.Backup(context.Background())
+	if err != nil || len(res.Sources[0].Archives) != 2 || r.Catalog().Len() != 2 {
+		t.Fatalf("Backup: %+v, %v", res, err)
+	}
+	if _, err := r.Seed(context.Background()); err == nil {
+		t.Error("Seed of a catalog in use succeeded")
+	}
+}
+
+func TestNewRunnerRejectsCorruptUploadState(t *testing.T) {
+	r, cfg := newTestRunner(t, RunOptions{})
+	r.Close()
+	os.WriteFile(filepath.Join(r.opts.Dir, "upload_state.json"), []byte(`{"completed_months": {"2024-05"`), 0644)
+	if _, err := NewRunner(context.Background(), cfg, RunOptions{Dir: r.opts.Dir, Out: io.Discard}); err == nil || !strings.Contains(err.Error(), "upload state") {
+		t.Errorf("NewRunner with a corrupt upload state: %v", err)
+	}
+	// The catalog was closed again, so the next run can open it
+	os.Remove(filepath.Join(r.opts.Dir, "upload_state.json"))
+	r2, err := NewRunner(context.Background(), cfg, RunOptions{Dir: r.opts.Dir, Out: io.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2.Close()
+}
+
+// badChecksumBackend reports a checksum that matches no upload.
+type badChecksumBackend struct{ Backend }
+
+func (b badChecksumBackend) Head(ctx context.Context, key string) (ObjectInfo, error) {
+	info, err := b.Backend.Head(ctx, key)
+	info.ChecksumSHA256 = "AAAA"
+	return info, err
+}
+
+func TestRunnerBackupFailsOnChecksumMismatch(t *testing.T) {
+	ctx := context.Background()
+	r, _ := newTestRunner(t, RunOptions{})
+	r.backend, r.retryDelay = badChecksumBackend{r.backend}, 0
+	res, err := r.Backup(ctx)
+	if err != nil || res.Failed != 2 || res.Sources[0].Archives[0].Uploaded {
+		t.Fatalf("Backup: %+v, %v", res, err)
+	}
+	if r.Catalog().Len() != 0 || len(r.State().CompletedMonths) != 0 {
+		t.Errorf("catalog %d entries, state %v", r.Catalog().Len(), r.State().CompletedMonths)
+	}
+	if objects, _ := r.Backend().List(ctx, ""); len(objects) != 1 || objects[0].Key != "photo_metadata.json" {
+		t.Errorf("objects left: %v", objects)
+	}
+}
+
+// cancellingBackend fails every archive upload and cancels the run on the first one.
+type cancellingBackend struct {
+	Backend
+	cancel context.CancelFunc
+	puts   atomic.Int32
+}
+
+func (b *cancellingBackend) Put(ctx context.Context, key string, r io.Reader, opts PutOptions) error {
+	if !strings.HasSuffix(key, ".zip") {
+		return b.Backend.Put(ctx, key, r, opts)
+	}
+	b.puts.Add(1)
+	b.cancel()
+	return context.Canceled
+}
+
+func TestRunnerStopsRetryingWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r, _ := newTestRunner(t, RunOptions{})
+	b := &cancellingBackend{Backend: r.backend, cancel: cancel}
+	r.backend, r.retryDelay = b, time.Hour
+	start := time.Now()
+	res, err := r.Backup(ctx)
+	if err != nil || res.Failed != 2 {
+		t.Fatalf("Backup: %+v, %v", res, err)
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("Backup took %v after it was cancelled", d)
+	}
+	if n := b.puts.Load(); n != 2 {
+		t.Errorf("%d uploads attempted, want one per archive", n)
+	}
+}
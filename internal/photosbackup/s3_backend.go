@@ -0,0 +1,156 @@
+package photosbackup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// S3Backend stores objects in an S3 bucket.
+type S3Backend struct {
+	client *s3.Client
+	bucket string
+	// PartSize is the multipart upload part size in bytes. Bodies smaller than
+	// one part are sent with a single PutObject. Zero uses the SDK default (5 MiB).
+	PartSize int64
+}
+
+// NewS3Backend returns a backend for bucket using the default AWS credential chain.
+func NewS3Backend(ctx context.Context, bucket, region string) (*S3Backend, error) {
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region))
+	if err != nil {
+		return nil, err
+	}
+	return &S3Backend{client: s3.NewFromConfig(cfg), bucket: bucket}, nil
+}
+
+// Put uploads body to key, streaming it as a multipart upload so the body
+// never has to be buffered in full or be seekable. S3 computes and stores a
+// SHA256 checksum (composite for multipart uploads) that Head reports back.
+func (b *S3Backend) Put(ctx context.Context, key string, body io.Reader, opts PutOptions) error {
+	input := &s3.PutObjectInput{
+		Bucket:            aws.String(b.bucket),
+		Key:               aws.String(key),
+		Body:              body,
+		ChecksumAlgorithm: types.ChecksumAlgorithmSha256,
+	}
+	if opts.StorageClass != "" {
+		input.StorageClass = types.StorageClass(opts.StorageClass)
+	}
+	uploader := manager.NewUploader(b.client, func(u *manager.Uploader) {
+		u.PartSize = max(b.UploadPartSize(), opts.PartSize)
+	})
+	_, err := uploader.Upload(ctx, input)
+	return err
+}
+
+// Get opens the object at key for reading.
+func (b *S3Backend) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	out, err := b.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, notFound(key, err)
+	}
+	return out.Body, nil
+}
+
+// Head returns the size, storage class and SHA256 checksum of the object at key.
+// HeadObject works for every storage class, including GLACIER and DEEP_ARCHIVE.
+func (b *S3Backend) Head(ctx context.Context, key string) (ObjectInfo, error) {
+	out, err := b.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:       aws.String(b.bucket),
+		Key:          aws.String(key),
+		ChecksumMode: types.ChecksumModeEnabled,
+	})
+	if err != nil {
+		return ObjectInfo{}, notFound(key, err)
+	}
+	return ObjectInfo{
+		Key:            key,
+		Size:           aws.ToInt64(out.ContentLength),
+		LastModified:   aws.ToTime(out.LastModified),
+		StorageClass:   string(out.StorageClass),
+		ChecksumSHA256: aws.ToString(out.ChecksumSHA256),
+	}, nil
+}
+
+// UploadPartSize returns the part size Put uses for multipart uploads, unless PutOptions
+// asks for larger parts.
+func (b *S3Backend) UploadPartSize() int64 {
+	if b.PartSize > 0 {
+		return b.PartSize
+	}
+	return manager.DefaultUploadPartSize
+}
+
+// ObjectPartSize returns the size of the first part of the object at key, or zero if it
+// was not uploaded in parts. Its composite checksum is computed over parts of this size,
+// which need not match UploadPartSize for objects uploaded with other settings.
+func (b *S3Backend) ObjectPartSize(ctx context.Context, key string) (int64, error) {
+	out, err := b.client.GetObjectAttributes(ctx, &s3.GetObjectAttributesInput{
+		Bucket:           aws.String(b.bucket),
+		Key:              aws.String(key),
+		ObjectAttributes: []types.ObjectAttributes{types.ObjectAttributesObjectParts},
+		MaxParts:         aws.Int32(1),
+	})
+	if err != nil {
+		return 0, notFound(key, err)
+	}
+	if out.ObjectParts == nil || len(out.ObjectParts.Parts) == 0 {
+		return 0, nil
+	}
+	return aws.ToInt64(out.ObjectParts.Parts[0].Size), nil
+}
+
+// List returns all objects whose key starts with prefix.
+func (b *S3Backend) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	p := s3.NewListObjectsV2Paginator(b.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(b.bucket),
+		Prefix: aws.String(prefix),
+	})
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range page.Contents {
+			objects = append(objects, ObjectInfo{
+				Key:          aws.ToString(obj.Key),
+				Size:         aws.ToInt64(obj.Size),
+				LastModified: aws.ToTime(obj.LastModified),
+				StorageClass: string(obj.StorageClass),
+			})
+		}
+	}
+	return objects, nil
+}
+
+// Delete removes the object at key.
+func (b *S3Backend) Delete(ctx context.Context, key string) error {
+	_, err := b.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(key),
+	})
+	return err
+}
+
+// notFound wraps S3 "no such key" errors so they match os.ErrNotExist.
+func notFound(key string, err error) error {
+	var nsk *types.NoSuchKey
+	var nf *types.NotFound
+	if errors.As(err, &nsk) || errors.As(err, &nf) {
+		return fmt.Errorf("%s: %w", key, os.ErrNotExist)
+	}
+	return err
+}
@@ -0,0 +1,388 @@
+package photosbackup
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ScanOptions controls which files FindNewPhotos reports.
+type ScanOptions struct {
+	AllowedExtensions []string
+	// Rules decide which files are included before AllowedExtensions is consulted.
+	Rules *RuleSet
+	// Catalog of backed-up files. Files recorded here with unchanged size and mtime are
+	// skipped; files whose content is already catalogued under another path are recorded
+	// as aliases of the existing entry and skipped.
+	Catalog *Catalog
+	// Cache of parsed metadata. Files with unchanged size and mtime are not reopened.
+	Cache *ScanCache
+	// Workers is the number of files hashed and parsed concurrently (default: number of CPUs).
+	Workers int
+	// DefaultZone is the zone of capture times that record none (nil for local).
+	DefaultZone *time.Location
+	// SidecarExtensions are the sidecar files backed up with their photo (nil for
+	// DefaultSidecarExtensions). They are never deduplicated by content.
+	SidecarExtensions []string
+	// Library, if set, adds what the Photos library records about each file to its metadata.
+	Library *PhotosLibrary
+	// ExcludeTrashed skips files the library has in Recently Deleted.
+	ExcludeTrashed bool
+	// SniffContent decides whether files not matched by a rule are photos or videos by
+	// their signature instead of their extension. Formats are included if one of their
+	// usual extensions is allowed.
+	SniffContent bool
+}
+
+// ScanResult is the outcome of FindNewPhotos.
+type ScanResult struct {
+	Files      []PhotoMeta         // New files to back up, one per distinct content, in walk order; sidecars follow their photo
+	Rules      []RuleMatch         // Files decided by each rule, in order, followed by the implicit rules
+	Duplicates map[string][]string // New file -> other new files with identical content
+	Known      int                 // Files whose content was already backed up under another path
+	Orphans    int                 // Sidecars without a photo, backed up on their own
+	Trashed    int                 // Files skipped because they are in the library's Recently Deleted
+	Mismatches []ContentMismatch   // Files whose content does not match their extension, with SniffContent
+	Stats      ScanStats
+}
+
+// ScanStats describes the throughput of a scan.
+type ScanStats struct {
+	Workers  int
+	Files    int   // Files included by the rules
+	Hashed   int   // Files read to compute their SHA256
+	Bytes    int64 // Bytes read to compute SHA256 checksums
+	Duration time.Duration
+}
+
+// Excluded returns the number of files excluded by any rule, by extension.
+func (r ScanResult) Excluded() map[string]int {
+	excluded := make(map[string]int)
+	for _, m := range r.Rules {
+		if m.Exclude {
+			for ext, n := range m.ByExt {
+				excluded[ext] += n
+			}
+		}
+	}
+	return excluded
+}
+
+// FilesPerSecond returns how many included files were examined per second.
+func (s ScanStats) FilesPerSecond() float64 {
+	if s.Duration <= 0 {
+		return 0
+	}
+	return float64(s.Files) / s.Duration.Seconds()
+}
+
+// MiBPerSecond returns the hashing throughput in MiB per second.
+func (s ScanStats) MiBPerSecond() float64 {
+	if s.Duration <= 0 {
+		return 0
+	}
+	return float64(s.Bytes) / (1 << 20) / s.Duration.Seconds()
+}
+
+// scanJob is an included file, numbered in walk order.
+type scanJob struct {
+	seq     int
+	path    string
+	info    os.FileInfo
+	sidecar bool
+}
+
+// scanItem is a worker's result for a scanJob.
+type scanItem struct {
+	scanJob
+	hashed bool   // the file was read
+	sum    string // SHA256, empty if the file is unchanged in the catalog or unreadable
+	known  bool   // the content is already catalogued
+	meta   PhotoMeta
+	ok     bool // meta is valid
+}
+
+// FindNewPhotos returns the photo files under root whose content is not yet backed up.
+// "New" means not in the catalog, regardless of capture date, so old photos imported
+// late are still found. Files are compared by SHA256, so identical copies are only
+// backed up once.
+//
+// One goroutine walks the tree and feeds a pool of workers that hash files and read
+// their metadata. Results are put back into walk order, so the outcome does not depend
+// on the number of workers. If ctx is cancelled the scan stops and returns ctx's error.
+//
+// Sidecars are backed up whenever they are new or changed, even if their photo is not,
+// and take the capture date of their photo so they are stored in the same month.
+//
+// With SniffContent, files no rule matches are recognized by their first bytes, so a
+// renamed or extensionless photo is still found and a damaged one is skipped; an ISO
+// media file of an unknown brand with an allowed extension is kept. Files whose content
+// and extension disagree are listed in the result's Mismatches.
+func FindNewPhotos(ctx context.Context, root string, opts ScanOptions) (ScanResult, error) {
+	start := time.Now()
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	res := ScanResult{Rules: opts.Rules.newRuleMatches(), Duplicates: make(map[string][]string)}
+	// Indexes of the implicit rules in res.Rules
+	allowedRule := opts.Rules.Len()
+	sidecarRule, otherRule, detectedRule, unrecognizedRule := allowedRule+1, allowedRule+2, allowedRule+3, allowedRule+4
+	allowed := make(map[string]bool)
+	for _, ext := range opts.AllowedExtensions {
+		allowed[strings.ToLower(ext)] = true
+	}
+	sidecarExts := opts.SidecarExtensions
+	if sidecarExts == nil {
+		sidecarExts = DefaultSidecarExtensions
+	}
+	sidecars := make(map[string]bool)
+	for _, ext := range sidecarExts {
+		sidecars[strings.ToLower(ext)] = true
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Walk the tree, counting the files each rule decides and queueing included ones
+	jobs := make(chan scanJob, 4*workers)
+	walkErr := make(chan error, 1)
+	go func() {
+		defer close(jobs)
+		seq := 0
+		walkErr <- filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err != nil || d.IsDir() {
+				return nil
+			}
+			ext := strings.ToLower(filepath.Ext(path))
+			rel, _ := filepath.Rel(root, path)
+			rule, ok := opts.Rules.match(filepath.ToSlash(rel), d)
+			switch {
+			case ok:
+			case sidecars[ext]:
+				rule = sidecarRule
+			case opts.SniffContent:
+				format := sniffFile(path)
+				switch {
+				case format != nil && format.allowedBy(allowed) && allowed[ext] && format.hasExt(ext):
+					rule = allowedRule
+				case format != nil && format.allowedBy(allowed):
+					rule = detectedRule
+					res.Mismatches = append(res.Mismatches, ContentMismatch{Path: path, Detected: format.Name, Included: true})
+				case format == formatISOMedia && allowed[ext]:
+					// Likely a video of a brand not listed; it is reported, not skipped
+					rule = allowedRule
+					res.Mismatches = append(res.Mismatches, ContentMismatch{Path: path, Detected: format.Name, Included: true})
+				case allowed[ext]:
+					rule = unrecognizedRule
+					m := ContentMismatch{Path: path}
+					if format != nil {
+						m.Detected = format.Name
+					}
+					res.Mismatches = append(res.Mismatches, m)
+				default:
+					rule = otherRule
+				}
+			case allowed[ext]:
+				rule = allowedRule
+			default:
+				rule = otherRule
+			}
+			res.Rules[rule].Files++
+			res.Rules[rule].ByExt[ext]++
+			if res.Rules[rule].Exclude {
+				return nil
+			}
+			if opts.ExcludeTrashed {
+				if asset, ok := opts.Library.Asset(path); ok && asset.Trashed {
+					res.Trashed++
+					return nil
+				}
+			}
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			select {
+			case jobs <- scanJob{seq: seq, path: path, info: info, sidecar: sidecars[ext]}:
+				seq++
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			return nil
+		})
+	}()
+
+	// Hash and parse files concurrently
+	results := make(chan scanItem, 4*workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				if ctx.Err() == nil {
+					results <- scanFile(job, opts)
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	var items []scanItem
+	for item := range results {
+		items = append(items, item)
+	}
+	if err := <-walkErr; err != nil {
+		return res, err
+	}
+	if err := ctx.Err(); err != nil {
+		return res, err
+	}
+
+	// Deduplicate in walk order so the first copy found is the one stored
+	sort.Slice(items, func(i, j int) bool { return items[i].seq < items[j].seq })
+	firstByHash := make(map[string]string)
+	photos := newSidecarIndex()
+	var sidecarItems []scanItem
+	for _, item := range items {
+		if item.hashed {
+			res.Stats.Hashed++
+			res.Stats.Bytes += item.info.Size()
+		}
+		if !item.sidecar {
+			photos.add(item.path)
+		}
+		if item.sum == "" {
+			continue
+		}
+		if item.sidecar {
+			sidecarItems = append(sidecarItems, item)
+			continue
+		}
+		if item.known {
+			known, err := opts.Catalog.AddAlias(item.sum, item.path, item.info)
+			if err != nil {
+				log.Printf("[ERROR] Failed to record %s in the catalog: %v", item.path, err)
+			}
+			if known {
+				res.Known++
+				continue
+			}
+		}
+		if first, ok := firstByHash[item.sum]; ok {
+			res.Duplicates[first] = append(res.Duplicates[first], item.path)
+			log.Printf("[INFO] %s has the same content as %s; storing it once", item.path, first)
+			continue
+		}
+		if !item.ok {
+			continue
+		}
+		firstByHash[item.sum] = item.path
+		res.Files = append(res.Files, item.meta)
+	}
+	pairWithOldStills(res.Files, items, opts)
+	res.Files = attachSidecars(res.Files, sidecarItems, photos, items, &res, opts)
+	res.Stats.Workers = workers
+	res.Stats.Files = len(items)
+	res.Stats.Duration = time.Since(start)
+	return res, nil
+}
+
+// scanFile hashes one file and, unless its content is already catalogued, reads its metadata.
+func scanFile(job scanJob, opts ScanOptions) scanItem {
+	item := scanItem{scanJob: job}
+	if opts.Catalog != nil && opts.Catalog.Unchanged(job.path, job.info) {
+		return item
+	}
+	item.hashed = true
+	sum, err := FileSHA256(job.path)
+	if err != nil {
+		log.Printf("[ERROR] Could not read %s: %v", job.path, err)
+		return item
+	}
+	item.sum = sum
+	if job.sidecar {
+		// Sidecars hold no capture date of their own; it is taken from their photo
+		item.meta = PhotoMeta{Path: job.path, Taken: inZoneOrLocal(job.info.ModTime(), opts.DefaultZone), Size: job.info.Size(), SHA256: sum}
+		item.ok = true
+		return item
+	}
+	if opts.Catalog != nil {
+		if _, ok := opts.Catalog.Lookup(sum); ok {
+			item.known = true
+			return item
+		}
+	}
+	item.meta, err = opts.Cache.PhotoMeta(job.path, job.info, opts.DefaultZone)
+	if err != nil {
+		log.Printf("[ERROR] Could not extract EXIF for %s: %v", job.path, err)
+		return item
+	}
+	item.meta.SHA256 = sum
+	if asset, ok := opts.Library.Asset(job.path); ok {
+		item.meta.Library = asset
+	}
+	item.ok = true
+	return item
+}
+
+// attachSidecars dates each sidecar like its photo and inserts it after the photo in
+// files. Sidecars of photos not in files, such as photos backed up earlier, and
+// sidecars without a photo follow at the end.
+func attachSidecars(files []PhotoMeta, sidecars []scanItem, photos *sidecarIndex, items []scanItem, res *ScanResult, opts ScanOptions) []PhotoMeta {
+	if len(sidecars) == 0 {
+		return files
+	}
+	byPath := make(map[string]scanItem, len(items))
+	for _, item := range items {
+		byPath[item.path] = item
+	}
+	metas := make([]PhotoMeta, 0, len(sidecars))
+	attached := make(map[string][]PhotoMeta)
+	for _, item := range sidecars {
+		meta := item.meta
+		primary, ok := photos.primary(item.path)
+		if !ok {
+			log.Printf("[WARN] No photo found for sidecar %s; backing it up on its own", item.path)
+			res.Orphans++
+			metas = append(metas, meta)
+			continue
+		}
+		meta.Primary = primary
+		p := byPath[primary]
+		pm, err := p.meta, error(nil)
+		if !p.ok {
+			// The photo is unchanged since its backup, or could not be parsed above
+			pm, err = opts.Cache.PhotoMeta(primary, p.info, opts.DefaultZone)
+		}
+		if err == nil {
+			meta.Taken, meta.TimeZone = pm.Taken, pm.TimeZone
+		}
+		metas = append(metas, meta)
+		attached[primary] = append(attached[primary], meta)
+	}
+	out := make([]PhotoMeta, 0, len(files)+len(metas))
+	inFiles := make(map[string]bool, len(files))
+	for _, f := range files {
+		out = append(out, f)
+		out = append(out, attached[f.Path]...)
+		inFiles[f.Path] = true
+	}
+	for _, meta := range metas {
+		if meta.Primary == "" || !inFiles[meta.Primary] {
+			out = append(out, meta)
+		}
+	}
+	return out
+}
@@ -0,0 +1,157 @@
+package photosbackup
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// scanCacheVersion is bumped whenever metadata extraction changes, so caches written
+// by older versions are discarded instead of serving stale metadata.
+const scanCacheVersion = 7
+
+// ScanCache stores parsed PhotoMeta by path so unchanged files are never reopened.
+// A nil *ScanCache is valid and parses every file. It is safe for concurrent use.
+type ScanCache struct {
+	Version int                        `json:"version"`
+	Entries map[string]*ScanCacheEntry `json:"entries"`
+
+	mu   sync.Mutex
+	hits int
+}
+
+// ScanCacheEntry is the metadata of one file, valid while its size and mtime are unchanged.
+type ScanCacheEntry struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	Zone    string    `json:"zone"` // Default zone the metadata was read with
+	Meta    PhotoMeta `json:"meta"`
+}
+
+// NewScanCache returns an empty scan cache.
+func NewScanCache() *ScanCache {
+	return &ScanCache{Version: scanCacheVersion, Entries: make(map[string]*ScanCacheEntry)}
+}
+
+// LoadScanCache reads the scan cache at path. A missing or outdated file yields an empty cache.
+func LoadScanCache(path string) (*ScanCache, error) {
+	c := NewScanCache()
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return c, nil // no cache yet
+		}
+		return nil, err
+	}
+	defer f.Close()
+	var stored ScanCache
+	if err := json.NewDecoder(f).Decode(&stored); err != nil {
+		return nil, err
+	}
+	if stored.Version == scanCacheVersion && stored.Entries != nil {
+		c.Entries = stored.Entries
+	}
+	return c, nil
+}
+
+// SaveScanCache writes the scan cache to path, replacing the previous file atomically.
+func SaveScanCache(path string, c *ScanCache) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".scancache-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := json.NewEncoder(tmp).Encode(c); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// PhotoMeta returns the metadata of the file at path, described by info, from the
+// cache if its size and mtime and the default zone are unchanged, otherwise by parsing
+// the file. zone is passed to getPhotoMeta.
+func (c *ScanCache) PhotoMeta(path string, info os.FileInfo, zone *time.Location) (PhotoMeta, error) {
+	if c == nil {
+		return getPhotoMeta(path, zone)
+	}
+	if zone == nil {
+		zone = time.Local
+	}
+	c.mu.Lock()
+	e, ok := c.Entries[path]
+	if ok && e.Size == info.Size() && e.ModTime.Equal(info.ModTime()) && e.Zone == zone.String() {
+		c.hits++
+		c.mu.Unlock()
+		return e.Meta, nil
+	}
+	c.mu.Unlock()
+	meta, err := getPhotoMeta(path, zone)
+	if err != nil {
+		return meta, err
+	}
+	c.mu.Lock()
+	c.Entries[path] = &ScanCacheEntry{Size: info.Size(), ModTime: info.ModTime(), Zone: zone.String(), Meta: meta}
+	c.mu.Unlock()
+	return meta, nil
+}
+
+// Hits returns the number of lookups served from the cache.
+func (c *ScanCache) Hits() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits
+}
+
+// Invalidate removes the entries for which match returns true and returns how many were removed.
+func (c *ScanCache) Invalidate(match func(path string, e *ScanCacheEntry) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for path, e := range c.Entries {
+		if match(path, e) {
+			delete(c.Entries, path)
+			n++
+		}
+	}
+	return n
+}
+
+// InvalidateAll matches every entry.
+func InvalidateAll(string, *ScanCacheEntry) bool { return true }
+
+// InvalidateStale matches entries whose file is gone or has changed.
+func InvalidateStale(path string, e *ScanCacheEntry) bool {
+	info, err := os.Stat(path)
+	return err != nil || info.Size() != e.Size || !info.ModTime().Equal(e.ModTime)
+}
+
+// InvalidateExtensions returns a matcher for entries with one of the given extensions.
+func InvalidateExtensions(exts []string) func(string, *ScanCacheEntry) bool {
+	set := make(map[string]bool)
+	for _, ext := range exts {
+		set[strings.ToLower(ext)] = true
+	}
+	return func(path string, _ *ScanCacheEntry) bool {
+		return set[strings.ToLower(filepath.Ext(path))]
+	}
+}
+
+// InvalidatePrefix returns a matcher for entries below the directory dir.
+func InvalidatePrefix(dir string) func(string, *ScanCacheEntry) bool {
+	dir = filepath.Clean(dir) + string(filepath.Separator)
+	return func(path string, _ *ScanCacheEntry) bool {
+		return strings.HasPrefix(path, dir)
+	}
+}
@@ -0,0 +1,83 @@
+package photosbackup
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestScanCacheReusesUnchangedFiles(t *testing.T) {
+	dir := t.TempDir()
+	file := dir + "/a.jpg"
+	os.WriteFile(file, []byte("photo"), 0644)
+	taken := time.Date(2019, 5, 1, 12, 0, 0, 0, time.UTC)
+	os.Chtimes(file, taken, taken)
+
+	c := NewScanCache()
+	opts := ScanOptions{AllowedExtensions: []string{".jpg"}, Cache: c}
+	if res := scanLibrary(t, dir, opts); len(res.Files) != 1 || c.Hits() != 0 {
+		t.Fatalf("first scan: files=%v hits=%d", res.Files, c.Hits())
+	}
+	cachePath := filepath.Join(t.TempDir(), "scan_cache.json")
+	if err := SaveScanCache(cachePath, c); err != nil {
+		t.Fatal(err)
+	}
+	c, err := LoadScanCache(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A cached entry is trusted while size and mtime match, so the file is not reparsed
+	c.Entries[file].Meta.Camera = "cached"
+	opts.Cache = c
+	res := scanLibrary(t, dir, opts)
+	if len(res.Files) != 1 || res.Files[0].Camera != "cached" || c.Hits() != 1 {
+		t.Fatalf("second scan: files=%v hits=%d", res.Files, c.Hits())
+	}
+	if !res.Files[0].Taken.Equal(taken) {
+		t.Errorf("cached Taken = %v, want %v", res.Files[0].Taken, taken)
+	}
+
+	// Changing the mtime invalidates the entry
+	later := taken.Add(time.Hour)
+	os.Chtimes(file, later, later)
+	if res := scanLibrary(t, dir, opts); res.Files[0].Camera == "cached" || !res.Files[0].Taken.Equal(later) {
+		t.Errorf("changed file served from cache: %+v", res.Files[0])
+	}
+}
+
+func TestScanCacheInvalidate(t *testing.T) {
+	dir := t.TempDir()
+	c := NewScanCache()
+	for _, name := range []string{"a.jpg", "b.heic", "sub/c.jpg"} {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		os.WriteFile(path, []byte(name), 0644)
+		info, _ := os.Stat(path)
+		if _, err := c.PhotoMeta(path, info, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := c.Invalidate(InvalidateExtensions([]string{".HEIC"})); n != 1 {
+		t.Errorf("extension invalidated %d entries, want 1", n)
+	}
+	if n := c.Invalidate(InvalidatePrefix(filepath.Join(dir, "sub"))); n != 1 {
+		t.Errorf("prefix invalidated %d entries, want 1", n)
+	}
+	os.Remove(filepath.Join(dir, "a.jpg"))
+	if n := c.Invalidate(InvalidateStale); n != 1 || len(c.Entries) != 0 {
+		t.Errorf("stale invalidated %d entries, %d left", n, len(c.Entries))
+	}
+}
+
+func TestLoadScanCacheDiscardsOtherVersions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "scan_cache.json")
+	os.WriteFile(path, []byte(`{"version":0,"entries":{"/x.jpg":{"size":1}}}`), 0644)
+	c, err := LoadScanCache(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Entries) != 0 {
+		t.Errorf("expected outdated entries to be dropped, got %v", c.Entries)
+	}
+}
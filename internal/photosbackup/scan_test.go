@@ -0,0 +1,60 @@
+package photosbackup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// scanLibrary runs FindNewPhotos and fails the test on error.
+func scanLibrary(t *testing.T, root string, opts ScanOptions) ScanResult {
+	t.Helper()
+	res, err := FindNewPhotos(context.Background(), root, opts)
+	if err != nil {
+		t.Fatalf("FindNewPhotos: %v", err)
+	}
+	return res
+}
+
+func TestFindNewPhotosOrderIsIndependentOfWorkers(t *testing.T) {
+	dir := t.TempDir()
+	for i := 0; i < 40; i++ {
+		sub := filepath.Join(dir, fmt.Sprintf("d%d", i%4))
+		os.MkdirAll(sub, 0755)
+		// Every fifth file repeats earlier content, so deduplication must also be stable
+		os.WriteFile(filepath.Join(sub, fmt.Sprintf("img%02d.jpg", i)), []byte(fmt.Sprint(i%35)), 0644)
+	}
+	want := scanLibrary(t, dir, ScanOptions{AllowedExtensions: []string{".jpg"}, Workers: 1})
+	if len(want.Files) != 35 || want.Stats.Files != 40 || want.Stats.Hashed != 40 {
+		t.Fatalf("unexpected single-worker scan: %d files, stats %+v", len(want.Files), want.Stats)
+	}
+	for run := 0; run < 5; run++ {
+		got := scanLibrary(t, dir, ScanOptions{AllowedExtensions: []string{".jpg"}, Workers: 8})
+		if len(got.Files) != len(want.Files) || len(got.Duplicates) != len(want.Duplicates) {
+			t.Fatalf("run %d: %d files, %d duplicates", run, len(got.Files), len(got.Duplicates))
+		}
+		for i := range want.Files {
+			if got.Files[i].Path != want.Files[i].Path {
+				t.Fatalf("run %d: file %d is %s, want %s", run, i, got.Files[i].Path, want.Files[i].Path)
+			}
+		}
+		for first, dups := range want.Duplicates {
+			if fmt.Sprint(got.Duplicates[first]) != fmt.Sprint(dups) {
+				t.Fatalf("run %d: duplicates of %s are %v, want %v", run, first, got.Duplicates[first], dups)
+			}
+		}
+	}
+}
+
+func TestFindNewPhotosCancelled(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(dir+"/a.jpg", []byte("a"), 0644)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := FindNewPhotos(ctx, dir, ScanOptions{AllowedExtensions: []string{".jpg"}}); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
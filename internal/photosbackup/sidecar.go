@@ -0,0 +1,76 @@
+package photosbackup
+
+import (
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DefaultSidecarExtensions are the sidecar files backed up with their photo when the
+// config does not list any: XMP metadata (edits, ratings, keywords) and Apple's AAE
+// edit descriptions.
+var DefaultSidecarExtensions = []string{".xmp", ".aae"}
+
+// A sidecar belongs to the photo in the same directory whose name it extends, such as
+// IMG_1234.HEIC.xmp (darktable), or whose stem it shares, such as IMG_1234.xmp
+// (Lightroom) or IMG_1234.AAE (Apple Photos).
+
+// sidecarIndex finds the photo a sidecar belongs to among the photos of a scan.
+type sidecarIndex struct {
+	byPath map[string]string   // lower-cased path -> path
+	byStem map[string][]string // lower-cased path without extension -> paths, in walk order
+}
+
+func newSidecarIndex() *sidecarIndex {
+	return &sidecarIndex{byPath: make(map[string]string), byStem: make(map[string][]string)}
+}
+
+// add records a photo that sidecars may belong to.
+func (x *sidecarIndex) add(path string) {
+	key := strings.ToLower(path)
+	x.byPath[key] = path
+	stem := strings.TrimSuffix(key, filepath.Ext(key))
+	x.byStem[stem] = append(x.byStem[stem], path)
+}
+
+// primary returns the photo the sidecar at path belongs to. Where a still and a video
+// share a stem, as in a Live Photo, the still is preferred.
+func (x *sidecarIndex) primary(path string) (string, bool) {
+	name := strings.ToLower(strings.TrimSuffix(path, filepath.Ext(path)))
+	if p, ok := x.byPath[name]; ok {
+		return p, true
+	}
+	candidates := x.byStem[name]
+	for _, p := range candidates {
+		if !videoExtensions[strings.ToLower(filepath.Ext(p))] {
+			return p, true
+		}
+	}
+	if len(candidates) > 0 {
+		return candidates[0], true
+	}
+	return "", false
+}
+
+// sidecarMember returns the member name for a sidecar stored next to its photo, which
+// was stored as primaryMember. The sidecar's name is rebuilt on the photo's member so
+// the pair stays together when the photo was renamed to avoid a clash.
+func sidecarMember(sidecar, primary, primaryMember string) string {
+	name, base := filepath.Base(sidecar), filepath.Base(primary)
+	if strings.HasPrefix(strings.ToLower(name), strings.ToLower(base)) {
+		return primaryMember + name[len(base):]
+	}
+	stem := strings.TrimSuffix(base, filepath.Ext(base))
+	if strings.HasPrefix(strings.ToLower(name), strings.ToLower(stem)) {
+		return strings.TrimSuffix(primaryMember, filepath.Ext(primaryMember)) + name[len(stem):]
+	}
+	return name
+}
+
+// inZoneOrLocal returns t in zone, or in the local zone if zone is nil.
+func inZoneOrLocal(t time.Time, zone *time.Location) time.Time {
+	if zone == nil {
+		return t.Local()
+	}
+	return t.In(zone)
+}
@@ -0,0 +1,115 @@
+package photosbackup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFindNewPhotosPairsSidecars(t *testing.T) {
+	dir := t.TempDir()
+	photo, _ := os.ReadFile("testdata/rich.jpg")
+	os.WriteFile(dir+"/IMG_1.jpg", photo, 0644)
+	os.WriteFile(dir+"/IMG_1.AAE", []byte("<plist/>"), 0644)
+	os.WriteFile(dir+"/IMG_1.jpg.xmp", []byte("<x:xmpmeta/>"), 0644)
+	os.WriteFile(dir+"/b.jpg", []byte("photo b"), 0644)
+	os.WriteFile(dir+"/b.xmp", []byte("<x:xmpmeta/>"), 0644) // same content as IMG_1.jpg.xmp
+	os.WriteFile(dir+"/orphan.xmp", []byte("<x:xmpmeta rating='5'/>"), 0644)
+
+	res := scanLibrary(t, dir, ScanOptions{AllowedExtensions: []string{".jpg"}})
+	want := []struct{ path, primary string }{
+		{"IMG_1.jpg", ""},
+		{"IMG_1.AAE", "IMG_1.jpg"},
+		{"IMG_1.jpg.xmp", "IMG_1.jpg"},
+		{"b.jpg", ""},
+		{"b.xmp", "b.jpg"},
+		{"orphan.xmp", ""},
+	}
+	if len(res.Files) != len(want) {
+		t.Fatalf("got %d files, want %d: %+v", len(res.Files), len(want), res.Files)
+	}
+	for i, w := range want {
+		f := res.Files[i]
+		if filepath.Base(f.Path) != w.path || (w.primary != "" && f.Primary != dir+"/"+w.primary) || (w.primary == "" && f.Primary != "") {
+			t.Errorf("file %d = %s (primary %q), want %s (primary %q)", i, f.Path, f.Primary, w.path, w.primary)
+		}
+	}
+	// Sidecars take the capture date of their photo
+	if taken := res.Files[0].Taken; !res.Files[1].Taken.Equal(taken) || !res.Files[2].Taken.Equal(taken) || res.Files[2].TimeZone != "+09:00" {
+		t.Errorf("sidecar dates %v, %v, want %v", res.Files[1].Taken, res.Files[2].Taken, taken)
+	}
+	if len(res.Duplicates) != 0 || res.Orphans != 1 || res.Excluded()[".xmp"] != 0 || res.Excluded()[".aae"] != 0 {
+		t.Errorf("duplicates %v, orphans %d, excluded %v", res.Duplicates, res.Orphans, res.Excluded())
+	}
+
+	// Sidecar extensions can be configured
+	res = scanLibrary(t, dir, ScanOptions{AllowedExtensions: []string{".jpg"}, SidecarExtensions: []string{".aae"}})
+	if len(res.Files) != 3 || res.Excluded()[".xmp"] != 3 {
+		t.Errorf("with only .aae sidecars: %d files, excluded %v", len(res.Files), res.Excluded())
+	}
+}
+
+func TestFindNewPhotosSidecarOfBackedUpPhoto(t *testing.T) {
+	dir := t.TempDir()
+	photo, _ := os.ReadFile("testdata/rich.jpg")
+	os.WriteFile(dir+"/IMG_1.jpg", photo, 0644)
+	info, _ := os.Stat(dir + "/IMG_1.jpg")
+	sum, _ := FileSHA256(dir + "/IMG_1.jpg")
+	c := openTestCatalog(t)
+	c.Add(&CatalogEntry{SHA256: sum, SourcePath: dir + "/IMG_1.jpg", Size: info.Size(), ModTime: info.ModTime()})
+
+	// An edit made after the backup is found on its own and dated like the photo
+	os.WriteFile(dir+"/IMG_1.xmp", []byte("<x:xmpmeta/>"), 0644)
+	res := scanLibrary(t, dir, ScanOptions{AllowedExtensions: []string{".jpg"}, Catalog: c})
+	if len(res.Files) != 1 || res.Files[0].Primary != dir+"/IMG_1.jpg" {
+		t.Fatalf("unexpected files %+v", res.Files)
+	}
+	if got := res.Files[0].Taken.Format("2006-01-02 15:04 -07:00"); got != "2022-12-31 23:30 +09:00" {
+		t.Errorf("sidecar taken %s", got)
+	}
+}
+
+func TestSidecarsRestoreNextToRenamedPhoto(t *testing.T) {
+	ctx := context.Background()
+	b, err := NewLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	os.Mkdir(dir+"/other", 0755)
+	os.WriteFile(dir+"/IMG_1.HEIC", []byte("photo"), 0644)
+	os.WriteFile(dir+"/other/IMG_1.HEIC", []byte("another photo"), 0644)
+	os.WriteFile(dir+"/other/IMG_1.AAE", []byte("edit"), 0644)
+	os.WriteFile(dir+"/other/IMG_1.HEIC.xmp", []byte("rating"), 0644)
+	files := []PhotoMeta{
+		{Path: dir + "/IMG_1.HEIC"},
+		{Path: dir + "/other/IMG_1.HEIC"},
+		{Path: dir + "/other/IMG_1.AAE", Primary: dir + "/other/IMG_1.HEIC"},
+		{Path: dir + "/other/IMG_1.HEIC.xmp", Primary: dir + "/other/IMG_1.HEIC"},
+	}
+	key := "2024/2024-04_20240501T120000.zip"
+	_, manifest, err := UploadZip(ctx, b, key, files, nil, PutOptions{})
+	if err != nil {
+		t.Fatalf("UploadZip: %v", err)
+	}
+	members := []string{"IMG_1.HEIC", "IMG_1 (2).HEIC", "IMG_1 (2).AAE", "IMG_1 (2).HEIC.xmp"}
+	for i, m := range members {
+		if manifest.Files[i].Member != m {
+			t.Errorf("member %d = %q, want %q", i, manifest.Files[i].Member, m)
+		}
+	}
+	if manifest.Files[2].Meta.Primary != dir+"/other/IMG_1.HEIC" {
+		t.Errorf("manifest does not record the photo of %s", manifest.Files[2].Path)
+	}
+
+	dest := t.TempDir()
+	if err := RestoreArchive(ctx, b, key, dest, "", nil, &RestoreStats{}); err != nil {
+		t.Fatalf("RestoreArchive: %v", err)
+	}
+	for _, m := range members {
+		if _, err := os.Stat(filepath.Join(dest, m)); err != nil {
+			t.Errorf("%s not restored: %v", m, err)
+		}
+	}
+}
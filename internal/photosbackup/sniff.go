@@ -0,0 +1,157 @@
+package photosbackup
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"strings"
+)
+
+// mediaFormat is a photo or video format recognized by the signature at the start of a file.
+type mediaFormat struct {
+	Name string
+	Exts []string // Extensions files of this format usually have; the first selects the parser
+}
+
+var (
+	formatJPEG = &mediaFormat{"JPEG", []string{".jpg", ".jpeg", ".jpe"}}
+	formatPNG  = &mediaFormat{"PNG", []string{".png"}}
+	formatHEIF = &mediaFormat{"HEIF", []string{".heic", ".heif", ".hif", ".avif"}}
+	// DNG and most raw formats are TIFF files
+	formatTIFF = &mediaFormat{"TIFF", []string{".tiff", ".tif", ".dng", ".nef", ".arw", ".orf", ".pef", ".srw", ".rw2"}}
+	formatCR2  = &mediaFormat{"Canon CR2", []string{".cr2"}}
+	formatCRW  = &mediaFormat{"Canon CRW", []string{".crw"}}
+	formatMOV  = &mediaFormat{"QuickTime", []string{".mov", ".qt"}}
+	formatMP4  = &mediaFormat{"MP4", []string{".mp4", ".m4v", ".3gp", ".3g2", ".mov"}}
+	formatAVI  = &mediaFormat{"AVI", []string{".avi"}}
+	formatHEVC = &mediaFormat{"HEVC", []string{".hevc", ".h265"}}
+	// formatISOMedia is an ISO base media file (it has an ftyp box) that is neither known
+	// to be a photo nor a video, such as M4A audio or a video of a brand not listed below.
+	// It has no usual extensions.
+	formatISOMedia = &mediaFormat{"ISO media of an unknown brand", nil}
+)
+
+// sniffLen is how much of a file is read to recognize its format.
+const sniffLen = 256
+
+// heifBrands are the ftyp brands of HEIF and AVIF images.
+var heifBrands = map[string]bool{
+	"heic": true, "heix": true, "hevc": true, "hevx": true, "heim": true, "heis": true,
+	"mif1": true, "msf1": true, "avif": true, "avis": true,
+}
+
+// mp4Brands are ftyp brands of MP4 videos, as written by cameras and phones. 3GPP brands
+// ("3gp4", "3g2a" etc.) are matched by prefix.
+var mp4Brands = map[string]bool{
+	"isom": true, "iso2": true, "iso3": true, "iso4": true, "iso5": true, "iso6": true,
+	"mp41": true, "mp42": true, "mp71": true, "avc1": true, "M4V ": true, "M4VH": true, "M4VP": true,
+	"dash": true, "XAVC": true, "MSNV": true, "mmp4": true, "f4v ": true,
+}
+
+// audioBrands are major ftyp brands of audio files, which list video brands such as
+// "isom" among their compatible brands.
+var audioBrands = map[string]bool{
+	"M4A ": true, "M4B ": true, "M4P ": true, "F4A ": true, "F4B ": true,
+}
+
+// sniffMedia returns the format whose signature head starts with, or nil.
+func sniffMedia(head []byte) *mediaFormat {
+	switch {
+	case bytes.HasPrefix(head, []byte{0xff, 0xd8, 0xff}):
+		return formatJPEG
+	case bytes.HasPrefix(head, []byte("\x89PNG\r\n\x1a\n")):
+		return formatPNG
+	case len(head) >= 14 && string(head[:2]) == "II" && string(head[6:14]) == "HEAPCCDR":
+		return formatCRW
+	case bytes.HasPrefix(head, []byte("II*\x00")) || bytes.HasPrefix(head, []byte("MM\x00*")):
+		if len(head) >= 10 && string(head[8:10]) == "CR" {
+			return formatCR2
+		}
+		return formatTIFF
+	case len(head) >= 12 && string(head[:4]) == "RIFF" && string(head[8:12]) == "AVI ":
+		return formatAVI
+	case len(head) >= 12 && string(head[4:8]) == "ftyp":
+		return sniffFtyp(head)
+	case len(head) >= 8 && (string(head[4:8]) == "moov" || string(head[4:8]) == "mdat" || string(head[4:8]) == "wide" || string(head[4:8]) == "pnot"):
+		return formatMOV // QuickTime files written before ftyp existed
+	case len(head) >= 5 && bytes.HasPrefix(head, []byte{0, 0, 0, 1}) && (head[4]>>1)&0x3f == 32:
+		return formatHEVC // Annex B stream starting with a video parameter set
+	}
+	return nil
+}
+
+// sniffFtyp tells HEIF images, QuickTime movies and MP4 videos apart by the major and
+// compatible brands of their ftyp box. Audio and unknown brands are formatISOMedia.
+func sniffFtyp(head []byte) *mediaFormat {
+	size := int(binary.BigEndian.Uint32(head[0:4]))
+	if size > len(head) || size < 16 {
+		size = len(head)
+	}
+	major := string(head[8:12])
+	brands := []string{major}
+	for off := 16; off+4 <= size; off += 4 {
+		brands = append(brands, string(head[off:off+4]))
+	}
+	for _, b := range brands {
+		if heifBrands[b] {
+			return formatHEIF
+		}
+	}
+	switch {
+	case major == "qt  ":
+		return formatMOV
+	case audioBrands[major]:
+		return formatISOMedia
+	}
+	for _, b := range brands {
+		if mp4Brands[b] || strings.HasPrefix(b, "3gp") || strings.HasPrefix(b, "3g2") {
+			return formatMP4
+		}
+	}
+	return formatISOMedia
+}
+
+// sniffFile returns the format of the file at path, or nil if it is not recognized.
+func sniffFile(path string) *mediaFormat {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	return sniffReader(f)
+}
+
+func sniffReader(r io.ReaderAt) *mediaFormat {
+	head := make([]byte, sniffLen)
+	n, _ := r.ReadAt(head, 0)
+	return sniffMedia(head[:n])
+}
+
+// hasExt reports whether ext is one of the usual extensions of the format.
+func (m *mediaFormat) hasExt(ext string) bool {
+	for _, e := range m.Exts {
+		if e == strings.ToLower(ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedBy reports whether any usual extension of the format is in allowed.
+func (m *mediaFormat) allowedBy(allowed map[string]bool) bool {
+	for _, e := range m.Exts {
+		if allowed[e] {
+			return true
+		}
+	}
+	return false
+}
+
+// ContentMismatch is a file whose content does not match its extension, found when
+// scanning with content sniffing.
+type ContentMismatch struct {
+	Path     string
+	Detected string // Format recognized from the content, or "" if none was
+	Included bool   // Whether the file is backed up
+}
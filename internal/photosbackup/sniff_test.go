@@ -0,0 +1,103 @@
+package photosbackup
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestSniffMedia(t *testing.T) {
+	tests := []struct {
+		head string
+		want *mediaFormat
+	}{
+		{"\xff\xd8\xff\xe1\x00\x10Exif", formatJPEG},
+		{"\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR", formatPNG},
+		{"\x00\x00\x00\x18ftypheic\x00\x00\x00\x00mif1heic", formatHEIF},
+		{"\x00\x00\x00\x18ftypmif1\x00\x00\x00\x00mif1avif", formatHEIF},
+		{"\x00\x00\x00\x14ftypqt  \x00\x00\x02\x00qt  ", formatMOV},
+		{"\x00\x00\x00\x18ftypisom\x00\x00\x02\x00isomiso2", formatMP4},
+		{"\x00\x00\x00\x14ftyp3gp4\x00\x00\x00\x00isom", formatMP4},
+		{"\x00\x00\x00\x1cftypM4A \x00\x00\x00\x00M4A mp42isom", formatISOMedia},
+		{"\x00\x00\x00\x1cftypiso5\x00\x00\x02\x00iso5iso6mp41", formatMP4},
+		{"\x00\x00\x00\x18ftypXAVC\x00\x00\x00\x00XAVCmp42", formatMP4},
+		{"\x00\x00\x00\x18ftypabcd\x00\x00\x00\x00abcdmp42", formatMP4},
+		{"\x00\x00\x00\x14ftypabcd\x00\x00\x00\x00abcd", formatISOMedia},
+		{"\x00\x00\x00\x08wide\x00\x00\x10\x00mdat", formatMOV},
+		{"II*\x00\x08\x00\x00\x00", formatTIFF},
+		{"MM\x00*\x00\x00\x00\x08", formatTIFF},
+		{"II*\x00\x10\x00\x00\x00CR\x02\x00", formatCR2},
+		{"II\x1a\x00\x00\x00HEAPCCDR", formatCRW},
+		{"RIFF\x00\x10\x00\x00AVI LIST", formatAVI},
+		{"\x00\x00\x00\x01\x40\x01\x0c\x01", formatHEVC},
+		{"RIFF\x00\x10\x00\x00WAVEfmt ", nil},
+		{"hello, world", nil},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		if got := sniffMedia([]byte(tt.head)); got != tt.want {
+			t.Errorf("sniffMedia(%q) = %v, want %v", tt.head, got, tt.want)
+		}
+	}
+}
+
+func TestFindNewPhotosSniffsContent(t *testing.T) {
+	dir := t.TempDir()
+	jpeg, _ := os.ReadFile("testdata/rich.jpg")
+	heic, _ := os.ReadFile("testdata/iphone.heic")
+	os.WriteFile(dir+"/a.jpg", jpeg, 0644)
+	// Trailing bytes keep the copies from being deduplicated
+	os.WriteFile(dir+"/renamed.bin", append(jpeg, 1), 0644)
+	os.WriteFile(dir+"/IMG_0001", append(jpeg, 2), 0644)
+	os.WriteFile(dir+"/photo.jpg", heic, 0644)
+	os.WriteFile(dir+"/corrupt.jpg", []byte("not a photo"), 0644)
+	os.WriteFile(dir+"/notes.txt", []byte("notes"), 0644)
+	// A video of an ftyp brand that is not known
+	os.WriteFile(dir+"/clip.mp4", []byte("\x00\x00\x00\x14ftypabcd\x00\x00\x00\x00abcd\x00\x00\x00\x08mdat"), 0644)
+	opts := ScanOptions{AllowedExtensions: []string{".jpg", ".heic", ".mp4"}}
+
+	// By extension, renamed photos are missed and the corrupt one is included
+	res := scanLibrary(t, dir, opts)
+	if len(res.Files) != 4 || len(res.Mismatches) != 0 {
+		t.Errorf("without sniffing: %d files, mismatches %+v", len(res.Files), res.Mismatches)
+	}
+
+	opts.SniffContent = true
+	res = scanLibrary(t, dir, opts)
+	var got []string
+	for _, f := range res.Files {
+		got = append(got, filepath.Base(f.Path))
+		if filepath.Base(f.Path) == "photo.jpg" && f.Make != "Apple" {
+			t.Errorf("HEIF named .jpg not parsed as HEIF: %+v", f)
+		}
+	}
+	sort.Strings(got)
+	if strings.Join(got, " ") != "IMG_0001 a.jpg clip.mp4 photo.jpg renamed.bin" {
+		t.Errorf("included %v", got)
+	}
+	want := map[string]ContentMismatch{
+		"renamed.bin": {Detected: "JPEG", Included: true},
+		"IMG_0001":    {Detected: "JPEG", Included: true},
+		"photo.jpg":   {Detected: "HEIF", Included: true},
+		"corrupt.jpg": {},
+		"clip.mp4":    {Detected: formatISOMedia.Name, Included: true},
+	}
+	if len(res.Mismatches) != len(want) {
+		t.Errorf("mismatches %+v", res.Mismatches)
+	}
+	for _, m := range res.Mismatches {
+		w, ok := want[filepath.Base(m.Path)]
+		if !ok || m.Detected != w.Detected || m.Included != w.Included {
+			t.Errorf("unexpected mismatch %+v", m)
+		}
+	}
+	counts := make(map[string]int)
+	for _, m := range res.Rules {
+		counts[m.Rule] = m.Files
+	}
+	if counts[RuleAllowedExtensions] != 2 || counts[RuleDetectedContent] != 3 || counts[RuleUnrecognizedContent] != 1 || counts[RuleOtherExtensions] != 1 {
+		t.Errorf("rule counts %v", counts)
+	}
+}
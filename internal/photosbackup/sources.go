@@ -0,0 +1,158 @@
+package photosbackup
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Source is a directory tree to back up, configured under sources. Each source is scanned
+// with its own filters, stores its archives below its own key prefix and keeps its resume
+// state in its own namespace of the upload state. Filters left unset are taken from the
+// top level of the config.
+type Source struct {
+	Name      string `yaml:"name"`       // Shown in output; also the default state namespace
+	Path      string `yaml:"path"`       // Root of the tree to back up
+	KeyPrefix string `yaml:"key_prefix"` // Prepended to the keys of the source's archives, e.g. "camera/"
+	State     string `yaml:"state"`      // Namespace in the upload state (default: name)
+	// Filters; a source's rules are checked before the top-level rules
+	AllowedExtensions []string `yaml:"allowed_extensions"`
+	Rules             []Rule   `yaml:"rules"`
+	SidecarExtensions []string `yaml:"sidecar_extensions"`
+	SniffContent      *bool    `yaml:"sniff_content"`
+	// Photos library of the source ("auto" or a path); not taken from the top level
+	PhotosDatabase string `yaml:"photos_database"`
+	ExcludeTrashed *bool  `yaml:"exclude_trashed"`
+}
+
+// BackupSources returns the sources to back up, with unset settings filled in from the
+// top level. Without a sources list, photos_library_path is the only source; it has no
+// name, no key prefix and uses the top-level state, as before sources existed.
+func (c *Config) BackupSources() ([]Source, error) {
+	if len(c.Sources) == 0 {
+		if c.PhotosLibrary == "" {
+			return nil, errors.New("photos_library_path or sources must be set")
+		}
+		return []Source{{
+			Path:              c.PhotosLibrary,
+			AllowedExtensions: c.AllowedExtensions,
+			Rules:             c.Rules,
+			SidecarExtensions: c.SidecarExtensions,
+			SniffContent:      &c.SniffContent,
+			PhotosDatabase:    c.PhotosDatabase,
+			ExcludeTrashed:    &c.ExcludeTrashed,
+		}}, nil
+	}
+	if c.PhotosLibrary != "" {
+		return nil, errors.New("photos_library_path cannot be combined with sources; add it to sources instead")
+	}
+	names := make(map[string]int)
+	states := make(map[string]int)
+	prefixes := make(map[string]int)
+	sources := make([]Source, len(c.Sources))
+	for i, s := range c.Sources {
+		if s.Name == "" {
+			return nil, fmt.Errorf("sources[%d]: name is required", i)
+		}
+		if s.Path == "" {
+			return nil, fmt.Errorf("sources[%d]: path is required", i)
+		}
+		if s.State == "" {
+			s.State = s.Name
+		}
+		if s.KeyPrefix = strings.Trim(s.KeyPrefix, "/"); s.KeyPrefix != "" {
+			s.KeyPrefix += "/"
+		}
+		if j, ok := names[s.Name]; ok {
+			return nil, fmt.Errorf("sources[%d]: name %q is already used by sources[%d]", i, s.Name, j)
+		}
+		if j, ok := states[s.State]; ok {
+			return nil, fmt.Errorf("sources[%d]: state %q is already used by sources[%d]", i, s.State, j)
+		}
+		// Archive names only carry the month and time, so sources must not share a prefix
+		if j, ok := prefixes[s.KeyPrefix]; ok {
+			return nil, fmt.Errorf("sources[%d]: key_prefix %q is already used by sources[%d]", i, s.KeyPrefix, j)
+		}
+		names[s.Name], states[s.State], prefixes[s.KeyPrefix] = i, i, i
+
+		if s.AllowedExtensions == nil {
+			s.AllowedExtensions = c.AllowedExtensions
+		}
+		s.Rules = append(append([]Rule(nil), s.Rules...), c.Rules...)
+		if s.SidecarExtensions == nil {
+			s.SidecarExtensions = c.SidecarExtensions
+		}
+		if s.SniffContent == nil {
+			s.SniffContent = &c.SniffContent
+		}
+		if s.ExcludeTrashed == nil {
+			s.ExcludeTrashed = &c.ExcludeTrashed
+		}
+		sources[i] = s
+	}
+	return sources, nil
+}
+
+// CompileSourceRules compiles the rules of src, a source returned by BackupSources: its
+// own rules followed by the top-level ones. Errors name the rule as it is written.
+func (c *Config) CompileSourceRules(src Source) (*RuleSet, error) {
+	own, err := CompileRules(src.Rules[:len(src.Rules)-len(c.Rules)])
+	if err != nil {
+		return nil, fmt.Errorf("source %q: %w", src.Name, err)
+	}
+	top, err := CompileRules(c.Rules)
+	if err != nil {
+		return nil, err
+	}
+	return &RuleSet{rules: append(own.rules, top.rules...)}, nil
+}
+
+// ArchiveKey returns the key of the archive zipName of the source, whose files were
+// mostly taken with camera. The whole key, with the source's prefix, must be a usable
+// S3 key.
+func (s *Source) ArchiveKey(cfg *Config, zipName, camera string) (string, error) {
+	key, err := S3Key(cfg, KeyValues{Zip: zipName, Source: s.Name, Camera: camera})
+	if err != nil {
+		return "", err
+	}
+	key = s.KeyPrefix + key
+	return key, checkKey(key)
+}
+
+// stateKey returns the key of an archive recorded in the upload state. Values are keys,
+// or the archive name for states written before keys were recorded.
+func (s *Source) stateKey(cfg *Config, value string) (string, error) {
+	if strings.Contains(value, "/") {
+		return value, nil
+	}
+	return s.ArchiveKey(cfg, value, "")
+}
+
+// listPrefix returns the prefix below which all archives of the source are stored.
+func (s *Source) listPrefix(cfg *Config) string {
+	t, err := cfg.keyTemplate()
+	if err != nil {
+		return s.KeyPrefix
+	}
+	return s.KeyPrefix + t.prefix(KeyValues{Source: s.Name, Hostname: cfg.Hostname})
+}
+
+// ownsArchive reports whether key is an archive key the source writes, with any camera
+// and storage class.
+func (s *Source) ownsArchive(cfg *Config, key string) bool {
+	t, err := cfg.keyTemplate()
+	if err != nil || !strings.HasPrefix(key, s.KeyPrefix) {
+		return false
+	}
+	re, err := t.match(KeyValues{Zip: path.Base(key), Source: s.Name, Hostname: cfg.Hostname})
+	return err == nil && re.MatchString(strings.TrimPrefix(key, s.KeyPrefix))
+}
+
+// Label returns how the source is named in output.
+func (s *Source) Label() string {
+	if s.Name == "" {
+		return s.Path
+	}
+	return s.Name
+}
@@ -0,0 +1,129 @@
+package photosbackup
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestBackupSources(t *testing.T) {
+	// Without sources, photos_library_path is the only, unnamed source
+	cfg := &Config{PhotosLibrary: "/photos", AllowedExtensions: []string{".jpg"}, SniffContent: true}
+	sources, err := cfg.BackupSources()
+	if err != nil || len(sources) != 1 {
+		t.Fatalf("BackupSources() = %+v, %v", sources, err)
+	}
+	if s := sources[0]; s.Path != "/photos" || s.Name != "" || s.State != "" || s.KeyPrefix != "" || !*s.SniffContent {
+		t.Errorf("legacy source %+v", s)
+	}
+	if key, err := sources[0].ArchiveKey(cfg, "2024-05_20240601T120000.zip", ""); key != "2024/2024-05_20240601T120000.zip" {
+		t.Errorf("legacy archive key %q, %v", key, err)
+	}
+
+	var withSources Config
+	err = yaml.Unmarshal([]byte(`
+allowed_extensions: [.jpg]
+rules:
+  - {action: exclude, hidden: true}
+sources:
+  - name: library
+    path: /photos
+    photos_database: auto
+  - name: camera
+    path: /camera
+    key_prefix: /camera/
+    allowed_extensions: [.cr2]
+    rules:
+      - {action: include, glob: "*.jpg"}
+    sniff_content: true
+`), &withSources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sources, err = withSources.BackupSources()
+	if err != nil || len(sources) != 2 {
+		t.Fatalf("BackupSources() = %+v, %v", sources, err)
+	}
+	lib, cam := sources[0], sources[1]
+	if lib.State != "library" || lib.KeyPrefix != "" || lib.AllowedExtensions[0] != ".jpg" || len(lib.Rules) != 1 || *lib.SniffContent {
+		t.Errorf("library source %+v", lib)
+	}
+	if cam.State != "camera" || cam.KeyPrefix != "camera/" || cam.AllowedExtensions[0] != ".cr2" || !*cam.SniffContent {
+		t.Errorf("camera source %+v", cam)
+	}
+	if len(cam.Rules) != 2 || cam.Rules[0].Glob != "*.jpg" || cam.Rules[1].Hidden == nil {
+		t.Errorf("camera rules %+v, want its own rule before the top-level one", cam.Rules)
+	}
+	if key, err := cam.ArchiveKey(&withSources, "2024-05_20240601T120000.zip", ""); key != "camera/2024/2024-05_20240601T120000.zip" {
+		t.Errorf("camera archive key %q, %v", key, err)
+	}
+
+	for _, tt := range []struct {
+		cfg  Config
+		want string
+	}{
+		{Config{}, "photos_library_path or sources must be set"},
+		{Config{PhotosLibrary: "/p", Sources: []Source{{Name: "a", Path: "/a"}}}, "cannot be combined"},
+		{Config{Sources: []Source{{Path: "/a"}}}, "sources[0]: name is required"},
+		{Config{Sources: []Source{{Name: "a"}}}, "sources[0]: path is required"},
+		{Config{Sources: []Source{{Name: "a", Path: "/a"}, {Name: "a", Path: "/b", KeyPrefix: "b"}}}, "sources[1]: name"},
+		{Config{Sources: []Source{{Name: "a", Path: "/a"}, {Name: "b", Path: "/b", State: "a", KeyPrefix: "b"}}}, "sources[1]: state"},
+		{Config{Sources: []Source{{Name: "a", Path: "/a"}, {Name: "b", Path: "/b"}}}, "sources[1]: key_prefix"},
+	} {
+		if _, err := tt.cfg.BackupSources(); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%+v: error %v, want %q", tt.cfg, err, tt.want)
+		}
+	}
+}
+
+func TestUploadStateKeepsSourcesApart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "upload_state.json")
+	state, _ := LoadUploadState(path)
+	state.Months("")["2024-05"] = "2024/2024-05_20240601T120000.zip"
+	state.Months("camera")["2024-05"] = "camera/2024/2024-05_20240601T130000.zip"
+	if err := SaveUploadState(path, state); err != nil {
+		t.Fatal(err)
+	}
+	state, err := LoadUploadState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.CompletedMonths["2024-05"] != "2024/2024-05_20240601T120000.zip" || state.Months("camera")["2024-05"] != "camera/2024/2024-05_20240601T130000.zip" || len(state.Months("family")) != 0 {
+		t.Errorf("state %+v", state)
+	}
+
+	cfg := &Config{Sources: []Source{{Name: "library", Path: "/photos"}, {Name: "camera", Path: "/camera", KeyPrefix: "camera"}}}
+	sources, _ := cfg.BackupSources()
+	// States written before keys were recorded hold the archive name
+	state.Months("library")["2024-06"] = "2024-06_20240701T120000.zip"
+	if keys := StateArchiveKeys(cfg, sources[0], state, "", ""); len(keys) != 1 || keys[0] != "2024/2024-06_20240701T120000.zip" {
+		t.Errorf("library keys %v", keys)
+	}
+	if keys := StateArchiveKeys(cfg, sources[1], state, "", ""); len(keys) != 1 || keys[0] != "camera/2024/2024-05_20240601T130000.zip" {
+		t.Errorf("camera keys %v", keys)
+	}
+}
+
+func TestSourceArchives(t *testing.T) {
+	ctx := context.Background()
+	b, err := NewLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"2024/2024-05_20240601T120000.zip", "camera/2024/2024-05_20240601T120000.zip", "test/2024/2024-05_20240601T120000.zip"} {
+		if err := b.Put(ctx, key, strings.NewReader("zip"), PutOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg := &Config{Sources: []Source{{Name: "library", Path: "/photos"}, {Name: "camera", Path: "/camera", KeyPrefix: "camera"}}}
+	sources, _ := cfg.BackupSources()
+	for i, want := range []string{"2024/2024-05_20240601T120000.zip", "camera/2024/2024-05_20240601T120000.zip"} {
+		archives, err := SourceArchives(ctx, b, cfg, sources[i], "", "")
+		if err != nil || len(archives) != 1 || archives[0].Key != want {
+			t.Errorf("SourceArchives(%s) = %v, %v, want [%s]", sources[i].Name, archives, err, want)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package photosbackup
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// EXIF stores capture times as local wall-clock time without a zone. The zone is
+// taken from, in order of preference, the OffsetTimeOriginal/OffsetTime tags, the
+// difference to the GPS timestamp (which is UTC), and the configured default zone.
+
+// DefaultZone returns the zone for capture times that record none (time_zone in the
+// config). It is the zone of the machine running the backup unless set.
+func (c *Config) DefaultZone() (*time.Location, error) {
+	if c.TimeZone == "" {
+		return time.Local, nil
+	}
+	loc, err := time.LoadLocation(c.TimeZone)
+	if err != nil {
+		return nil, fmt.Errorf("time_zone: %w", err)
+	}
+	return loc, nil
+}
+
+// BucketZone returns the zone capture times are converted to before they are grouped
+// into months (bucket_time_zone in the config). It is nil for "capture", the default,
+// which groups every photo by the wall-clock time where it was taken.
+func (c *Config) BucketZone() (*time.Location, error) {
+	if c.BucketTimeZone == "" || strings.EqualFold(c.BucketTimeZone, "capture") {
+		return nil, nil
+	}
+	loc, err := time.LoadLocation(c.BucketTimeZone)
+	if err != nil {
+		return nil, fmt.Errorf("bucket_time_zone: %w", err)
+	}
+	return loc, nil
+}
+
+// exifTimeLayout is the format of EXIF date and time tags.
+const exifTimeLayout = "2006:01:02 15:04:05"
+
+// exifTaken returns the capture time of x and the UTC offset it was placed in, such as
+// "+02:00", or "" if zone was used because x records no offset.
+func exifTaken(x *exif.Exif, zone *time.Location) (time.Time, string, bool) {
+	s := exifString(x, exif.DateTimeOriginal)
+	if s == "" {
+		s = exifString(x, exif.DateTime)
+	}
+	// Parse as UTC to keep the wall clock as recorded; it is placed in a zone below
+	wall, err := time.Parse(exifTimeLayout, strings.TrimSpace(s))
+	if err != nil {
+		return time.Time{}, "", false
+	}
+	for _, name := range []exif.FieldName{OffsetTimeOriginal, OffsetTime} {
+		if loc, ok := parseUTCOffset(exifString(x, name)); ok {
+			return inZone(wall, loc), loc.String(), true
+		}
+	}
+	if utc, ok := exifGPSTime(x); ok {
+		// The offset is the difference between the wall clock and UTC, which is only
+		// meaningful if both were taken at about the same time
+		offset := wall.Sub(utc).Round(15 * time.Minute)
+		if offset >= -14*time.Hour && offset <= 14*time.Hour && absDuration(wall.Sub(utc)-offset) < 5*time.Minute {
+			loc := fixedZone(int(offset / time.Second))
+			return inZone(wall, loc), loc.String(), true
+		}
+	}
+	return inZone(wall, zone), "", true
+}
+
+// exifGPSTime returns the UTC time of the GPS fix recorded in x.
+func exifGPSTime(x *exif.Exif) (time.Time, bool) {
+	day, err := time.Parse("2006:01:02", strings.TrimSpace(exifString(x, exif.GPSDateStamp)))
+	if err != nil {
+		return time.Time{}, false
+	}
+	tag, err := x.Get(exif.GPSTimeStamp)
+	if err != nil || tag.Count < 3 {
+		return time.Time{}, false
+	}
+	var secs float64
+	for i, unit := range []float64{3600, 60, 1} {
+		num, den, err := tag.Rat2(i)
+		if err != nil || den == 0 {
+			return time.Time{}, false
+		}
+		secs += float64(num) / float64(den) * unit
+	}
+	return day.Add(time.Duration(secs * float64(time.Second))), true
+}
+
+// parseUTCOffset parses an EXIF offset such as "+09:00" or "-05:30".
+func parseUTCOffset(s string) (*time.Location, bool) {
+	t, err := time.Parse("-07:00", strings.TrimSpace(s))
+	if err != nil {
+		return nil, false
+	}
+	_, offset := t.Zone()
+	return fixedZone(offset), true
+}
+
+// fixedZone returns a zone at offset seconds east of UTC, named like "+09:00".
+func fixedZone(offset int) *time.Location {
+	return time.FixedZone(time.Unix(0, 0).In(time.FixedZone("", offset)).Format("-07:00"), offset)
+}
+
+// inZone returns the time with the wall clock of wall (read in UTC) in loc.
+func inZone(wall time.Time, loc *time.Location) time.Time {
+	if loc == nil {
+		loc = time.Local
+	}
+	return time.Date(wall.Year(), wall.Month(), wall.Day(), wall.Hour(), wall.Minute(), wall.Second(), wall.Nanosecond(), loc)
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
@@ -0,0 +1,53 @@
+package photosbackup
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGetPhotoMetaTimeZone(t *testing.T) {
+	newYork := time.FixedZone("EST", -5*3600)
+	tests := []struct {
+		file     string
+		want     time.Time
+		timeZone string
+	}{
+		// OffsetTimeOriginal wins over the default zone
+		{"testdata/rich.jpg", time.Date(2022, 12, 31, 23, 30, 0, 0, time.FixedZone("", 9*3600)), "+09:00"},
+		// No offset tag: the offset is derived from the GPS timestamp (UTC)
+		{"testdata/gps_time.jpg", time.Date(2023, 1, 1, 0, 30, 0, 0, time.FixedZone("", 9*3600)), "+09:00"},
+		// Neither: the wall clock is read in the default zone
+		{"testdata/no_zone.jpg", time.Date(2023, 1, 1, 0, 30, 0, 0, newYork), ""},
+	}
+	for _, tt := range tests {
+		meta, err := getPhotoMeta(tt.file, newYork)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.file, err)
+		}
+		if !meta.Taken.Equal(tt.want) || meta.TimeZone != tt.timeZone {
+			t.Errorf("%s: Taken = %v (%q), want %v (%q)", tt.file, meta.Taken, meta.TimeZone, tt.want, tt.timeZone)
+		}
+		if meta.Taken.Hour() != tt.want.Hour() {
+			t.Errorf("%s: wall clock changed: %v", tt.file, meta.Taken)
+		}
+	}
+}
+
+func TestGroupPhotosByYearMonthZone(t *testing.T) {
+	// Taken half an hour into the new year in Tokyo, still December in UTC
+	photos := []PhotoMeta{{Path: "a.jpg", Taken: time.Date(2023, 1, 1, 0, 30, 0, 0, time.FixedZone("+09:00", 9*3600))}}
+	if groups := GroupPhotosByYearMonth(photos, nil); len(groups["2023-01"]) != 1 {
+		t.Errorf("capture zone: got %v", groups)
+	}
+	cfg := &Config{BucketTimeZone: "UTC"}
+	zone, err := cfg.BucketZone()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if groups := GroupPhotosByYearMonth(photos, zone); len(groups["2022-12"]) != 1 {
+		t.Errorf("UTC: got %v", groups)
+	}
+	if _, err := (&Config{TimeZone: "Mars/Olympus_Mons"}).DefaultZone(); err == nil {
+		t.Error("expected an error for an unknown zone")
+	}
+}
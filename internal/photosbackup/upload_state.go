@@ -2,11 +2,17 @@ package photosbackup
 
 import (
 	"encoding/json"
+	"fmt"
 	"os"
+	"slices"
 )
 
 type UploadState struct {
-	CompletedMonths map[string]string `json:"completed_months"` // map[year-month]zipName
+	CompletedMonths map[string]string            `json:"completed_months"`  // map[year-month]latest archive key
+	Sources         map[string]map[string]string `json:"sources,omitempty"` // CompletedMonths of named sources, by state namespace
+	// History lists every archive recorded for a month, oldest first, by state namespace
+	// ("" for photos_library_path). CompletedMonths only keeps the latest one.
+	History map[string]map[string][]string `json:"history,omitempty"`
 }
 
 func LoadUploadState(path string) (*UploadState, error) {
@@ -19,7 +25,12 @@ func LoadUploadState(path string) (*UploadState, error) {
 		return nil, err
 	}
 	defer f.Close()
-	json.NewDecoder(f).Decode(state)
+	if err := json.NewDecoder(f).Decode(state); err != nil {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+	if state.CompletedMonths == nil {
+		state.CompletedMonths = make(map[string]string)
+	}
 	return state, nil
 }
 
@@ -33,3 +44,57 @@ func SaveUploadState(path string, state *UploadState) error {
 	enc.SetIndent("", "  ")
 	return enc.Encode(state)
 }
+
+// Months returns the completed months of the source with the given state namespace.
+// The unnamed source, photos_library_path, uses CompletedMonths.
+func (s *UploadState) Months(namespace string) map[string]string {
+	if namespace == "" {
+		if s.CompletedMonths == nil {
+			s.CompletedMonths = make(map[string]string)
+		}
+		return s.CompletedMonths
+	}
+	if s.Sources == nil {
+		s.Sources = make(map[string]map[string]string)
+	}
+	if s.Sources[namespace] == nil {
+		s.Sources[namespace] = make(map[string]string)
+	}
+	return s.Sources[namespace]
+}
+
+// Record makes key the latest archive of month ym of the source with the given state
+// namespace, keeping the one it replaces in the month's history.
+func (s *UploadState) Record(namespace, ym, key string) {
+	months := s.Months(namespace)
+	if s.History == nil {
+		s.History = make(map[string]map[string][]string)
+	}
+	if s.History[namespace] == nil {
+		s.History[namespace] = make(map[string][]string)
+	}
+	history := s.History[namespace]
+	// States written before the history was kept only know the latest archive
+	if prev := months[ym]; prev != "" && !slices.Contains(history[ym], prev) {
+		history[ym] = append(history[ym], prev)
+	}
+	if !slices.Contains(history[ym], key) {
+		history[ym] = append(history[ym], key)
+	}
+	months[ym] = key
+}
+
+// Archives returns every archive recorded for each month of the source with the given
+// state namespace, oldest first.
+func (s *UploadState) Archives(namespace string) map[string][]string {
+	archives := make(map[string][]string)
+	for ym, values := range s.History[namespace] {
+		archives[ym] = append(archives[ym], values...)
+	}
+	for ym, value := range s.Months(namespace) {
+		if !slices.Contains(archives[ym], value) {
+			archives[ym] = append(archives[ym], value)
+		}
+	}
+	return archives
+}
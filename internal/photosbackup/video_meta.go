@@ -0,0 +1,234 @@
+package photosbackup
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// videoExtensions are the QuickTime and MP4 file types whose metadata is read from atoms.
+var videoExtensions = map[string]bool{".mov": true, ".mp4": true, ".m4v": true, ".3gp": true, ".3g2": true}
+
+// videoMeta is the metadata found in the moov atom of a QuickTime or MP4 file.
+type videoMeta struct {
+	Created     time.Time
+	TimeZone    string // UTC offset recorded with Created, if any
+	Make        string
+	Model       string
+	Latitude    float64
+	Longitude   float64
+	Altitude    float64
+	HasLocation bool
+	Width       int // Pixels, of the largest video track
+	Height      int
+	Duration    float64 // Seconds
+	ContentID   string  // Live Photo content identifier
+}
+
+// qtEpoch is the origin of QuickTime and MP4 timestamps.
+var qtEpoch = time.Date(1904, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// readVideoMeta reads the metadata of the QuickTime or MP4 file r, which is size bytes long.
+// The creation time is taken from, in order of preference, the Apple creationdate key
+// (which carries the recording's UTC offset), the ©day user data and the mvhd atom.
+func readVideoMeta(r io.ReaderAt, size int64) (videoMeta, error) {
+	var vm videoMeta
+	moov, err := readTopLevelBox(r, size, "moov")
+	if err != nil {
+		return vm, err
+	}
+	if moov == nil {
+		return vm, errors.New("no moov atom")
+	}
+	var mvhdCreated, dayCreated time.Time
+	walkBoxes(moov, func(typ string, payload []byte) bool {
+		switch typ {
+		case "mvhd":
+			mvhdCreated, vm.Duration = parseMvhd(payload)
+		case "udta":
+			dayCreated = parseUserData(payload, &vm)
+		case "meta":
+			parseQuickTimeMeta(payload, &vm)
+		case "trak":
+			if w, h := parseTrackSize(findBox(payload, "tkhd")); w*h > vm.Width*vm.Height {
+				vm.Width, vm.Height = w, h
+			}
+		}
+		return true
+	})
+	if vm.Created.IsZero() {
+		vm.Created = dayCreated
+	}
+	if vm.Created.IsZero() {
+		vm.Created = mvhdCreated
+	}
+	return vm, nil
+}
+
+// parseMvhd returns the creation time (UTC) and duration in seconds from a movie header.
+func parseMvhd(p []byte) (time.Time, float64) {
+	var created, timescale, duration uint64
+	switch {
+	case len(p) >= 32 && p[0] == 1:
+		created = binary.BigEndian.Uint64(p[4:12])
+		timescale = uint64(binary.BigEndian.Uint32(p[20:24]))
+		duration = binary.BigEndian.Uint64(p[24:32])
+	case len(p) >= 20:
+		created = uint64(binary.BigEndian.Uint32(p[4:8]))
+		timescale = uint64(binary.BigEndian.Uint32(p[12:16]))
+		duration = uint64(binary.BigEndian.Uint32(p[16:20]))
+	default:
+		return time.Time{}, 0
+	}
+	var t time.Time
+	if created != 0 {
+		t = qtEpoch.Add(time.Duration(created) * time.Second)
+	}
+	var secs float64
+	if timescale != 0 {
+		secs = float64(duration) / float64(timescale)
+	}
+	return t, secs
+}
+
+// parseTrackSize returns the presentation size of a track from its header. It is zero
+// for sound tracks.
+func parseTrackSize(tkhd []byte) (width, height int) {
+	if len(tkhd) < 84 {
+		return 0, 0
+	}
+	// Width and height are 16.16 fixed-point numbers at the end of the header
+	width = int(binary.BigEndian.Uint32(tkhd[len(tkhd)-8:]) >> 16)
+	height = int(binary.BigEndian.Uint32(tkhd[len(tkhd)-4:]) >> 16)
+	return width, height
+}
+
+// parseUserData reads the ©xyz, ©mak and ©mod entries of a udta atom into vm and
+// returns the date of its ©day entry, if any.
+func parseUserData(p []byte, vm *videoMeta) time.Time {
+	var day time.Time
+	walkBoxes(p, func(typ string, payload []byte) bool {
+		switch typ {
+		case "\xa9xyz":
+			if !vm.HasLocation {
+				vm.Latitude, vm.Longitude, vm.Altitude, vm.HasLocation = parseISO6709(userDataText(payload))
+			}
+		case "\xa9mak":
+			if vm.Make == "" {
+				vm.Make = userDataText(payload)
+			}
+		case "\xa9mod":
+			if vm.Model == "" {
+				vm.Model = userDataText(payload)
+			}
+		case "\xa9day":
+			day, _, _ = parseVideoDate(userDataText(payload))
+		}
+		return true
+	})
+	return day
+}
+
+// userDataText decodes a QuickTime international text item: a 16-bit length,
+// a 16-bit language code and the text.
+func userDataText(p []byte) string {
+	if len(p) < 4 {
+		return ""
+	}
+	n := int(binary.BigEndian.Uint16(p[0:2]))
+	if n > len(p)-4 {
+		n = len(p) - 4
+	}
+	return string(p[4 : 4+n])
+}
+
+// parseQuickTimeMeta reads the Apple metadata keys (keys and ilst atoms) of a meta atom into vm.
+func parseQuickTimeMeta(p []byte, vm *videoMeta) {
+	// In MP4 files meta is a full box with a version and flags before its children
+	if len(p) >= 4 && binary.BigEndian.Uint32(p[0:4]) == 0 {
+		p = p[4:]
+	}
+	var keys []string // ilst items refer to keys by 1-based index
+	if k := findBox(p, "keys"); len(k) >= 8 {
+		count := binary.BigEndian.Uint32(k[4:8])
+		k = k[8:]
+		for i := uint32(0); i < count && len(k) >= 8; i++ {
+			n := binary.BigEndian.Uint32(k[0:4])
+			if n < 8 || n > uint32(len(k)) {
+				break
+			}
+			keys = append(keys, string(k[8:n]))
+			k = k[n:]
+		}
+	}
+	walkBoxes(findBox(p, "ilst"), func(typ string, item []byte) bool {
+		idx := int(binary.BigEndian.Uint32([]byte(typ)))
+		data := findBox(item, "data")
+		if idx < 1 || idx > len(keys) || len(data) < 8 {
+			return true
+		}
+		value := string(data[8:]) // after the type indicator and locale
+		switch keys[idx-1] {
+		case "com.apple.quicktime.creationdate":
+			if t, zone, ok := parseVideoDate(value); ok {
+				vm.Created, vm.TimeZone = t, zone
+			}
+		case "com.apple.quicktime.location.ISO6709":
+			if lat, long, alt, ok := parseISO6709(value); ok {
+				vm.Latitude, vm.Longitude, vm.Altitude, vm.HasLocation = lat, long, alt, true
+			}
+		case "com.apple.quicktime.make":
+			vm.Make = value
+		case "com.apple.quicktime.model":
+			vm.Model = value
+		case "com.apple.quicktime.content.identifier":
+			vm.ContentID = value
+		}
+		return true
+	})
+}
+
+// videoDateLayouts are the date formats found in creationdate and ©day entries,
+// the first two with a UTC offset.
+var videoDateLayouts = []string{
+	"2006-01-02T15:04:05Z0700",
+	"2006-01-02T15:04:05Z07:00",
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+}
+
+// parseVideoDate parses a creation date and returns the UTC offset it carries, such
+// as "+02:00", or "" if it has none. Dates without a UTC offset are taken as UTC.
+func parseVideoDate(s string) (time.Time, string, bool) {
+	for i, layout := range videoDateLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			if i < 2 {
+				return t, t.Format("-07:00"), true
+			}
+			return t, "", true
+		}
+	}
+	return time.Time{}, "", false
+}
+
+// iso6709Re matches the decimal-degree latitude, longitude and optional altitude at
+// the start of an ISO 6709 location such as "+37.3349-122.0090+010.000/".
+var iso6709Re = regexp.MustCompile(`^([+-]\d{1,2}(?:\.\d+)?)([+-]\d{1,3}(?:\.\d+)?)([+-]\d+(?:\.\d+)?)?`)
+
+// parseISO6709 parses an ISO 6709 location in decimal degrees, with altitude in metres.
+func parseISO6709(s string) (lat, long, alt float64, ok bool) {
+	m := iso6709Re.FindStringSubmatch(s)
+	if m == nil {
+		return 0, 0, 0, false
+	}
+	lat, _ = strconv.ParseFloat(m[1], 64)
+	long, _ = strconv.ParseFloat(m[2], 64)
+	alt, _ = strconv.ParseFloat(m[3], 64) // zero if absent
+	if lat < -90 || lat > 90 || long < -180 || long > 180 {
+		return 0, 0, 0, false
+	}
+	return lat, long, alt, true
+}
@@ -0,0 +1,114 @@
+package photosbackup
+
+import (
+	"encoding/binary"
+	"os"
+	"testing"
+	"time"
+)
+
+// box encodes an ISO-BMFF box of type typ holding the concatenated payloads.
+func box(typ string, payloads ...[]byte) []byte {
+	var body []byte
+	for _, p := range payloads {
+		body = append(body, p...)
+	}
+	b := binary.BigEndian.AppendUint32(nil, uint32(8+len(body)))
+	return append(append(b, typ...), body...)
+}
+
+func u32(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+
+// qtText encodes a QuickTime user data text item.
+func qtText(s string) []byte {
+	b := binary.BigEndian.AppendUint16(nil, uint16(len(s)))
+	return append(binary.BigEndian.AppendUint16(b, 0x15c7), s...)
+}
+
+// mvhd encodes a version 0 movie header created at t with the given duration.
+func mvhd(t time.Time, timescale, duration uint32) []byte {
+	created := uint32(t.Sub(qtEpoch) / time.Second)
+	return box("mvhd", u32(0), u32(created), u32(created), u32(timescale), u32(duration), make([]byte, 80))
+}
+
+func writeMovie(t *testing.T, moov []byte) string {
+	t.Helper()
+	// moov after a large mdat, as cameras write it
+	data := append(box("ftyp", []byte("qt  "), u32(0), []byte("qt  ")), box("mdat", make([]byte, 4096))...)
+	path := t.TempDir() + "/IMG_0001.MOV"
+	if err := os.WriteFile(path, append(data, moov...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestGetPhotoMetaReadsQuickTimeMetadata(t *testing.T) {
+	utc := time.Date(2023, 7, 14, 16, 22, 5, 0, time.UTC)
+	key := func(name string) []byte { return box("mdta", []byte(name)) }
+	keys := box("keys", u32(0), u32(5),
+		key("com.apple.quicktime.location.ISO6709"),
+		key("com.apple.quicktime.make"),
+		key("com.apple.quicktime.model"),
+		key("com.apple.quicktime.creationdate"),
+		key("com.apple.quicktime.content.identifier"))
+	item := func(idx uint32, value string) []byte {
+		return box(string(u32(idx)), box("data", u32(1), u32(0), []byte(value)))
+	}
+	ilst := box("ilst",
+		item(1, "+48.8584+002.2945+035.000/"),
+		item(2, "Apple"),
+		item(3, "iPhone 14 Pro"),
+		item(4, "2023-07-14T18:22:05+0200"),
+		item(5, "8C1B3E02-5D0F-4F4B-9A4B-2E4A4F3C0C11"))
+	moov := box("moov",
+		mvhd(utc.Add(time.Minute), 600, 6000),
+		box("trak", box("tkhd", u32(0), make([]byte, 72), u32(1920<<16), u32(1080<<16))),
+		box("meta", box("hdlr", make([]byte, 24)), keys, ilst))
+
+	meta, err := getPhotoMeta(writeMovie(t, moov), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !meta.Taken.Equal(utc) {
+		t.Errorf("Taken = %v, want %v from creationdate", meta.Taken, utc)
+	}
+	if _, offset := meta.Taken.Zone(); offset != 2*3600 || meta.TimeZone != "+02:00" {
+		t.Errorf("Taken lost its UTC offset: %v, TimeZone %q", meta.Taken, meta.TimeZone)
+	}
+	if meta.Make != "Apple" || meta.Camera != "iPhone 14 Pro" {
+		t.Errorf("device = %q %q", meta.Make, meta.Camera)
+	}
+	if meta.Latitude != 48.8584 || meta.Longitude != 2.2945 || meta.Altitude != 35 {
+		t.Errorf("location = %f, %f, %f", meta.Latitude, meta.Longitude, meta.Altitude)
+	}
+	if meta.Width != 1920 || meta.Height != 1080 {
+		t.Errorf("size = %dx%d, want 1920x1080", meta.Width, meta.Height)
+	}
+	if meta.Duration != 10 {
+		t.Errorf("Duration = %v, want 10", meta.Duration)
+	}
+	if meta.ContentID != "8C1B3E02-5D0F-4F4B-9A4B-2E4A4F3C0C11" {
+		t.Errorf("ContentID = %q", meta.ContentID)
+	}
+}
+
+func TestGetPhotoMetaFallsBackToMovieHeader(t *testing.T) {
+	created := time.Date(2014, 12, 31, 23, 30, 0, 0, time.UTC)
+	moov := box("moov",
+		mvhd(created, 1000, 2500),
+		box("udta", box("\xa9xyz", qtText("-33.8568+151.2153/")), box("\xa9mod", qtText("Pixel 8"))))
+
+	meta, err := getPhotoMeta(writeMovie(t, moov), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !meta.Taken.Equal(created) || meta.Duration != 2.5 {
+		t.Errorf("Taken = %v, Duration = %v", meta.Taken, meta.Duration)
+	}
+	if meta.Camera != "Pixel 8" || meta.Latitude != -33.8568 || meta.Longitude != 151.2153 {
+		t.Errorf("unexpected user data: %+v", meta)
+	}
+	if groups := GroupPhotosByYearMonth([]PhotoMeta{meta}, nil); len(groups["2014-12"]) != 1 {
+		t.Errorf("video not grouped by its creation month: %v", groups)
+	}
+}